@@ -0,0 +1,204 @@
+package gotcp
+
+import (
+	"errors"
+	"log"
+	"sync"
+)
+
+var ErrBrokerClosed = errors.New("broker closed")
+
+// maxDeliveryAttempts is how many times the memory broker hands a message
+// to the handlers of a channel before dropping it
+const maxDeliveryAttempts = 5
+
+// MessageHandler handles a message consumed from a topic, the message is
+// delivered again when it returns an error
+type MessageHandler func(body []byte) error
+
+// Broker is the message queue Mqhub publishes to and consumes from. Every
+// channel of a topic gets a copy of each message, the handlers subscribed
+// to the same channel share its messages.
+type Broker interface {
+	Publish(topic string, body []byte) error
+	Subscribe(topic, channel string, handler MessageHandler) error
+
+	// Healthy returns nil if the broker can publish
+	Healthy() error
+
+	Close() error
+}
+
+// MemoryBroker is an in-process Broker, messages published to a topic
+// without channels are kept until the first channel is subscribed
+type MemoryBroker struct {
+	lock    sync.Mutex
+	topics  map[string]*memoryTopic
+	closed  bool
+	running sync.WaitGroup
+}
+
+type memoryTopic struct {
+	channels map[string]*memoryChannel
+	backlog  [][]byte
+}
+
+type memoryMessage struct {
+	body     []byte
+	attempts int
+}
+
+type memoryChannel struct {
+	lock     sync.Mutex
+	cond     *sync.Cond
+	messages []memoryMessage
+	closed   bool
+}
+
+// NewMemoryBroker creates an empty in-process broker
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		topics: make(map[string]*memoryTopic),
+	}
+}
+
+func (b *MemoryBroker) topic(name string) *memoryTopic {
+	t, ok := b.topics[name]
+	if !ok {
+		t = &memoryTopic{channels: make(map[string]*memoryChannel)}
+		b.topics[name] = t
+	}
+
+	return t
+}
+
+func (b *MemoryBroker) Publish(topic string, body []byte) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed {
+		return ErrBrokerClosed
+	}
+
+	t := b.topic(topic)
+	if len(t.channels) == 0 {
+		t.backlog = append(t.backlog, body)
+		return nil
+	}
+	for _, ch := range t.channels {
+		ch.push(memoryMessage{body: body})
+	}
+
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(topic, channel string, handler MessageHandler) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed {
+		return ErrBrokerClosed
+	}
+
+	t := b.topic(topic)
+	ch, ok := t.channels[channel]
+	if !ok {
+		ch = &memoryChannel{}
+		ch.cond = sync.NewCond(&ch.lock)
+		t.channels[channel] = ch
+		for _, body := range t.backlog {
+			ch.push(memoryMessage{body: body})
+		}
+		t.backlog = nil
+	}
+
+	b.running.Add(1)
+	go func() {
+		defer b.running.Done()
+		ch.consume(topic, handler)
+	}()
+
+	return nil
+}
+
+func (b *MemoryBroker) Healthy() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed {
+		return ErrBrokerClosed
+	}
+
+	return nil
+}
+
+// Close stops the consumers once they handled the message in hand,
+// the messages not consumed yet are dropped
+func (b *MemoryBroker) Close() error {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return nil
+	}
+	b.closed = true
+	for _, t := range b.topics {
+		for _, ch := range t.channels {
+			ch.close()
+		}
+	}
+	b.lock.Unlock()
+
+	b.running.Wait()
+	return nil
+}
+
+func (ch *memoryChannel) push(m memoryMessage) {
+	ch.lock.Lock()
+	ch.messages = append(ch.messages, m)
+	ch.lock.Unlock()
+	ch.cond.Signal()
+}
+
+// pop waits for a message, false once the channel is closed
+func (ch *memoryChannel) pop() (memoryMessage, bool) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+
+	for len(ch.messages) == 0 && !ch.closed {
+		ch.cond.Wait()
+	}
+	if ch.closed {
+		return memoryMessage{}, false
+	}
+
+	m := ch.messages[0]
+	ch.messages[0] = memoryMessage{}
+	ch.messages = ch.messages[1:]
+
+	return m, true
+}
+
+func (ch *memoryChannel) close() {
+	ch.lock.Lock()
+	ch.closed = true
+	ch.lock.Unlock()
+	ch.cond.Broadcast()
+}
+
+func (ch *memoryChannel) consume(topic string, handler MessageHandler) {
+	for {
+		m, ok := ch.pop()
+		if !ok {
+			return
+		}
+
+		if err := handler(m.body); err != nil {
+			m.attempts++
+			if m.attempts < maxDeliveryAttempts {
+				ch.push(m)
+				continue
+			}
+			log.Printf("drop message of topic %s after %d attempts: %v", topic, m.attempts, err)
+		}
+	}
+}
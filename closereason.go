@@ -0,0 +1,91 @@
+package gotcp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrRejected closes the conn with CloseRejected when OnConnect or OnMessage
+// returns false, or when an InboundHandler returns it
+var ErrRejected = errors.New("rejected by the callback")
+
+// CloseKind tells what closed a connection
+type CloseKind int
+
+const (
+	CloseLocal      CloseKind = iota // Conn.Close was called
+	ClosePeer                        // the peer closed the connection
+	CloseReadError                   // reading failed, with the error of the Protocol
+	CloseWriteError                  // writing failed
+	CloseRejected                    // OnConnect or OnMessage returned false, see ErrRejected
+	CloseHandler                     // a pipeline handler returned an error
+	CloseIdle                        // the conn was idle too long, see IdleCallback
+	ClosePanic                       // a loop of the conn panicked
+	CloseShutdown                    // the server was shut down
+	CloseHandshake                   // the TLS handshake failed
+	CloseTakenOver                   // its device ID logged in on another conn
+)
+
+func (k CloseKind) String() string {
+	switch k {
+	case CloseLocal:
+		return "local"
+	case ClosePeer:
+		return "peer"
+	case CloseReadError:
+		return "read error"
+	case CloseWriteError:
+		return "write error"
+	case CloseRejected:
+		return "rejected"
+	case CloseHandler:
+		return "handler"
+	case CloseIdle:
+		return "idle"
+	case ClosePanic:
+		return "panic"
+	case CloseShutdown:
+		return "shutdown"
+	case CloseHandshake:
+		return "handshake"
+	case CloseTakenOver:
+		return "taken over"
+	}
+
+	return "unknown"
+}
+
+// CloseReason is why a connection was closed, recorded by the first close
+type CloseReason struct {
+	Kind CloseKind
+	Err  error // the underlying error, nil for CloseLocal
+}
+
+func (r CloseReason) String() string {
+	if r.Err == nil {
+		return r.Kind.String()
+	}
+
+	return r.Kind.String() + ": " + r.Err.Error()
+}
+
+// CloseReasonCallback is an optional interface of ConnCallback,
+// OnCloseReason is called instead of OnClose with why the conn was closed
+type CloseReasonCallback interface {
+	OnCloseReason(*Conn, CloseReason)
+}
+
+// readReason is the close reason of the read error err
+func readReason(err error) CloseReason {
+	if err == io.EOF {
+		return CloseReason{Kind: ClosePeer, Err: err}
+	}
+
+	return CloseReason{Kind: CloseReadError, Err: err}
+}
+
+// panicReason is the close reason of the recovered value r
+func panicReason(r interface{}) CloseReason {
+	return CloseReason{Kind: ClosePanic, Err: fmt.Errorf("panic: %v", r)}
+}
@@ -0,0 +1,174 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"sync/atomic"
+
+	"github.com/giskook/gotcp"
+)
+
+var ErrChecksum = errors.New("codec: checksum mismatch")
+
+// Checksum computes the integrity check carried by a frame
+type Checksum interface {
+	Size() int                      // the size of the checksum in the frame
+	Append(dst, data []byte) []byte // appends the checksum of data to dst
+}
+
+type checksumFunc struct {
+	size   int
+	append func(dst, data []byte) []byte
+}
+
+func (c *checksumFunc) Size() int {
+	return c.size
+}
+
+func (c *checksumFunc) Append(dst, data []byte) []byte {
+	return c.append(dst, data)
+}
+
+var (
+	// XOR is the block check character, the xor of all the bytes
+	XOR Checksum = &checksumFunc{1, func(dst, data []byte) []byte {
+		var x byte
+		for _, b := range data {
+			x ^= b
+		}
+		return append(dst, x)
+	}}
+
+	// Sum8 is the sum of all the bytes modulo 256
+	Sum8 Checksum = &checksumFunc{1, func(dst, data []byte) []byte {
+		var sum byte
+		for _, b := range data {
+			sum += b
+		}
+		return append(dst, sum)
+	}}
+
+	// CRC16Modbus is CRC-16/MODBUS, sent little endian
+	CRC16Modbus Checksum = &checksumFunc{2, func(dst, data []byte) []byte {
+		crc := uint16(0xFFFF)
+		for _, b := range data {
+			crc ^= uint16(b)
+			for i := 0; i < 8; i++ {
+				if crc&1 != 0 {
+					crc = crc>>1 ^ 0xA001
+				} else {
+					crc >>= 1
+				}
+			}
+		}
+		return append(dst, byte(crc), byte(crc>>8))
+	}}
+
+	// CRC16CCITT is CRC-16/CCITT-FALSE, sent big endian
+	CRC16CCITT Checksum = &checksumFunc{2, func(dst, data []byte) []byte {
+		crc := uint16(0xFFFF)
+		for _, b := range data {
+			crc ^= uint16(b) << 8
+			for i := 0; i < 8; i++ {
+				if crc&0x8000 != 0 {
+					crc = crc<<1 ^ 0x1021
+				} else {
+					crc <<= 1
+				}
+			}
+		}
+		return append(dst, byte(crc>>8), byte(crc))
+	}}
+
+	// CRC32 is the IEEE CRC-32, sent big endian
+	CRC32 Checksum = &checksumFunc{4, func(dst, data []byte) []byte {
+		var sum [4]byte
+		binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(data))
+		return append(dst, sum[:]...)
+	}}
+)
+
+// CorruptAction tells what to do with a frame failing the checksum
+type CorruptAction int
+
+const (
+	CorruptDrop  CorruptAction = iota // skip the frame and read the next one
+	CorruptClose                      // close the connection
+)
+
+// Verify is a checksum stage attached to a codec, the checksum sits at
+// the end of the frame, before Trailer bytes such as an end tag:
+//
+//	| Skip | covered bytes | checksum | Trailer |
+//
+// Frames are passed on to the next DecodeFunc without the checksum.
+type Verify struct {
+	Checksum Checksum
+	Skip     int // the bytes at the start of the frame not covered, such as a start tag
+	Trailer  int // the bytes after the checksum
+
+	// OnCorrupt decides what happens to a corrupt frame, nil means CorruptDrop
+	OnCorrupt func(frame []byte, err error) CorruptAction
+
+	corrupt uint64 // the number of corrupt frames
+}
+
+// Corrupt returns the number of corrupt frames seen so far
+func (v *Verify) Corrupt() uint64 {
+	return atomic.LoadUint64(&v.corrupt)
+}
+
+// Decode returns a DecodeFunc that verifies a frame before passing it on to decode
+func (v *Verify) Decode(decode DecodeFunc) DecodeFunc {
+	return func(frame []byte) (gotcp.Packet, error) {
+		end := len(frame) - v.Trailer - v.Checksum.Size()
+		if end < v.Skip {
+			return v.corruptFrame(frame, ErrChecksum)
+		}
+
+		var sum [8]byte
+		expected := v.Checksum.Append(sum[:0], frame[v.Skip:end])
+		for i, b := range expected {
+			if frame[end+i] != b {
+				return v.corruptFrame(frame, ErrChecksum)
+			}
+		}
+
+		frame = append(frame[:end], frame[len(frame)-v.Trailer:]...)
+		return decode(frame)
+	}
+}
+
+func (v *Verify) corruptFrame(frame []byte, err error) (gotcp.Packet, error) {
+	atomic.AddUint64(&v.corrupt, 1)
+
+	if v.OnCorrupt != nil && v.OnCorrupt(frame, err) == CorruptClose {
+		return nil, err
+	}
+
+	return nil, ErrDrop
+}
+
+// Append inserts the checksum into an outbound frame, before its Trailer bytes
+func (v *Verify) Append(frame []byte) []byte {
+	end := len(frame) - v.Trailer
+	out := make([]byte, 0, len(frame)+v.Checksum.Size())
+	out = append(out, frame[:end]...)
+	out = v.Checksum.Append(out, frame[v.Skip:end])
+	return append(out, frame[end:]...)
+}
+
+// Wrap returns p serialized with the checksum inserted
+func (v *Verify) Wrap(p gotcp.Packet) gotcp.Packet {
+	return &checkedPacket{verify: v, packet: p}
+}
+
+type checkedPacket struct {
+	verify *Verify
+	packet gotcp.Packet
+}
+
+func (p *checkedPacket) Serialize() []byte {
+	return p.verify.Append(p.packet.Serialize())
+}
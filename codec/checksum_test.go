@@ -0,0 +1,76 @@
+package codec
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChecksumVectors(t *testing.T) {
+	// the check values of the catalogue of CRC algorithms, over "123456789"
+	data := []byte("123456789")
+	for _, v := range []struct {
+		name     string
+		checksum Checksum
+		expected []byte
+	}{
+		{"XOR", XOR, []byte{0x31}},
+		{"Sum8", Sum8, []byte{0xDD}},
+		{"CRC16Modbus", CRC16Modbus, []byte{0x37, 0x4B}},
+		{"CRC16CCITT", CRC16CCITT, []byte{0x29, 0xB1}},
+		{"CRC32", CRC32, []byte{0xCB, 0xF4, 0x39, 0x26}},
+	} {
+		got := v.checksum.Append([]byte{0xEE}, data)
+		if !bytes.Equal(got[1:], v.expected) || got[0] != 0xEE {
+			t.Errorf("%s: % X, expected % X", v.name, got[1:], v.expected)
+		}
+		if v.checksum.Size() != len(v.expected) {
+			t.Errorf("%s: size %d", v.name, v.checksum.Size())
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	// | start tag | body | crc | end tag |
+	v := &Verify{Checksum: CRC16Modbus, Skip: 1, Trailer: 1}
+	tagged := &Tagged{Start: []byte{'<'}, End: []byte(">"), Decode: v.Decode(decodeRaw)}
+
+	good := v.Append([]byte("<01>"))
+	if !bytes.Equal(good, []byte{'<', '0', '1', 0xD4, 0x64, '>'}) {
+		t.Fatalf("appended % X", good)
+	}
+
+	corrupt := append([]byte(nil), good...)
+	corrupt[1] = '2'
+
+	// the corrupt frame is dropped and counted, the checksum is cut from the good ones
+	stream := append(append(append([]byte(nil), good...), corrupt...), good...)
+	expectFrames(t, readAll(t, tagged.Read, oneByte(stream)), "<01>", "<01>")
+	if v.Corrupt() != 1 {
+		t.Fatalf("%d corrupt frames", v.Corrupt())
+	}
+}
+
+func TestVerifyClose(t *testing.T) {
+	var seen []byte
+	v := &Verify{
+		Checksum: XOR,
+		OnCorrupt: func(frame []byte, err error) CorruptAction {
+			seen = frame
+			return CorruptClose
+		},
+	}
+	fixed := &FixedLength{Length: 3, Decode: v.Decode(decodeRaw)}
+
+	if _, err := fixed.Read(oneByte([]byte{0x01, 0x02, 0x00})); err != ErrChecksum {
+		t.Fatalf("corrupt frame: %v", err)
+	}
+	if !bytes.Equal(seen, []byte{0x01, 0x02, 0x00}) {
+		t.Fatalf("OnCorrupt got % X", seen)
+	}
+
+	// a frame shorter than the checksum
+	short := (&Verify{Checksum: CRC32}).Decode(decodeRaw)
+	if p, err := short([]byte{0x01, 0x02}); err != ErrDrop || p != nil {
+		t.Fatalf("short frame: %v %v", p, err)
+	}
+}
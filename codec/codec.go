@@ -0,0 +1,46 @@
+// Package codec provides ready made gotcp.Protocol implementations for the
+// common ways of framing a byte stream. Each of them cuts a frame out of
+// the Conn read buffer and hands it to a DecodeFunc that builds the Packet.
+// Their Read method does the same on a gotcp.FrameReader, for clients.
+package codec
+
+import (
+	"errors"
+
+	"github.com/giskook/gotcp"
+)
+
+const defaultMaxFrameLength = 64 * 1024
+
+var (
+	ErrFrameTooLong = errors.New("codec: frame longer than the limit")
+
+	// ErrConfig is returned by Read when the codec can not frame anything,
+	// such as a Delimiter without delimiter
+	ErrConfig = errors.New("codec: invalid configuration")
+
+	// ErrDrop is returned by a DecodeFunc to skip the frame and read the
+	// next one instead of closing the connection
+	ErrDrop = errors.New("codec: frame dropped")
+)
+
+// DecodeFunc turns a frame into a packet, the frame is owned by the callee
+type DecodeFunc func(frame []byte) (gotcp.Packet, error)
+
+// readPacket calls read until it returns a frame that is not dropped
+func readPacket(r *gotcp.FrameReader, read func(r *gotcp.FrameReader) (gotcp.Packet, error)) (gotcp.Packet, error) {
+	for {
+		p, err := read(r)
+		if err != ErrDrop {
+			return p, err
+		}
+	}
+}
+
+func maxLength(limit int) int {
+	if limit <= 0 {
+		return defaultMaxFrameLength
+	}
+
+	return limit
+}
@@ -0,0 +1,165 @@
+package codec
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/giskook/gotcp"
+)
+
+type rawPacket []byte
+
+func (p rawPacket) Serialize() []byte {
+	return p
+}
+
+func decodeRaw(frame []byte) (gotcp.Packet, error) {
+	return rawPacket(frame), nil
+}
+
+// oneByte returns a reader handing out stream a byte per read, so every
+// frame straddles many reads
+func oneByte(stream []byte) *gotcp.FrameReader {
+	return gotcp.NewFrameReader(iotest.OneByteReader(bytes.NewReader(stream)))
+}
+
+// readAll reads frames until the stream ends
+func readAll(t *testing.T, read func(*gotcp.FrameReader) (gotcp.Packet, error), r *gotcp.FrameReader) []string {
+	var frames []string
+	for {
+		p, err := read(r)
+		if err == io.EOF {
+			return frames
+		}
+		if err != nil {
+			t.Fatalf("after %q: %v", frames, err)
+		}
+		frames = append(frames, string(p.Serialize()))
+	}
+}
+
+func expectFrames(t *testing.T, got []string, expected ...string) {
+	t.Helper()
+	if len(got) != len(expected) {
+		t.Fatalf("frames %q, expected %q", got, expected)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("frames %q, expected %q", got, expected)
+		}
+	}
+}
+
+func TestLengthField(t *testing.T) {
+	// a start byte and a length not counting the last byte of the body
+	l := &LengthField{Offset: 1, Size: 2, Adjustment: 1, Strip: 3, Decode: decodeRaw}
+	stream := append(l.AppendLength([]byte{0xAA}, []byte("hello!")), l.AppendLength([]byte{0xAA}, []byte("hi!"))...)
+
+	expectFrames(t, readAll(t, l.Read, oneByte(stream)), "hello!", "hi!")
+}
+
+func TestLengthFieldLimit(t *testing.T) {
+	l := &LengthField{Size: 2, MaxLength: 8, Decode: decodeRaw}
+	if _, err := l.Read(oneByte(l.AppendLength(nil, []byte("123456")))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Read(oneByte(l.AppendLength(nil, []byte("1234567")))); err != ErrFrameTooLong {
+		t.Fatalf("frame over the limit: %v", err)
+	}
+
+	huge := &LengthField{Size: 8, Decode: decodeRaw}
+	if _, err := huge.Read(oneByte(bytes.Repeat([]byte{0xFF}, 8))); err != ErrFrameTooLong {
+		t.Fatalf("8 byte length: %v", err)
+	}
+
+	// a length field counting the frame, yet smaller than the field
+	whole := &LengthField{Size: 2, Adjustment: -2, Decode: decodeRaw}
+	if _, err := whole.Read(oneByte([]byte{0, 1})); err == nil || err == ErrFrameTooLong {
+		t.Fatalf("negative frame: %v", err)
+	}
+}
+
+func TestDelimiter(t *testing.T) {
+	d := &Delimiter{Delimiter: []byte("\r\n"), Decode: decodeRaw}
+	expectFrames(t, readAll(t, d.Read, oneByte([]byte("a\rb\r\n\r\nc\r\n"))), "a\rb", "", "c")
+
+	d.KeepDelimiter = true
+	expectFrames(t, readAll(t, d.Read, oneByte([]byte("a\r\nb\r\n"))), "a\r\n", "b\r\n")
+}
+
+func TestDelimiterLimit(t *testing.T) {
+	d := &Delimiter{Delimiter: []byte("\r\n"), MaxLength: 4, Decode: decodeRaw}
+	if _, err := d.Read(oneByte([]byte("ab\r\n"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Read(oneByte([]byte("abc\r\n"))); err != ErrFrameTooLong {
+		t.Fatalf("delimiter past the limit: %v", err)
+	}
+	if _, err := d.Read(oneByte([]byte("abcdefgh"))); err != ErrFrameTooLong {
+		t.Fatalf("no delimiter within the limit: %v", err)
+	}
+}
+
+func TestFixedLength(t *testing.T) {
+	f := &FixedLength{Length: 3, Decode: decodeRaw}
+	expectFrames(t, readAll(t, f.Read, oneByte([]byte("abcdef"))), "abc", "def")
+}
+
+func TestTaggedResync(t *testing.T) {
+	tagged := &Tagged{Start: []byte{'<'}, End: []byte(">"), Decode: decodeRaw}
+	expectFrames(t, readAll(t, tagged.Read, oneByte([]byte("xx<a>y<b>"))), "<a>", "<b>")
+
+	tagged.StripTags = true
+	expectFrames(t, readAll(t, tagged.Read, oneByte([]byte("<a>"))), "a")
+}
+
+func TestTaggedLength(t *testing.T) {
+	// frames starting with 'F' are 5 bytes long, the end tag may appear in the body
+	tagged := &Tagged{
+		Start:  []byte{'F', 'V'},
+		End:    []byte("#"),
+		Length: func(start byte) int { return map[byte]int{'F': 5}[start] },
+		Decode: decodeRaw,
+	}
+
+	// the first 'F' lacks its end tag, the stream resyncs on the next byte
+	stream := []byte("F1#2xF#23#V3#")
+	expectFrames(t, readAll(t, tagged.Read, oneByte(stream)), "F#23#", "V3#")
+}
+
+func TestTaggedLimit(t *testing.T) {
+	tagged := &Tagged{Start: []byte{'<'}, End: []byte(">"), MaxLength: 4, Decode: decodeRaw}
+
+	// a frame over the limit is skipped, not fatal
+	expectFrames(t, readAll(t, tagged.Read, oneByte([]byte("<abcd><e>"))), "<e>")
+}
+
+func TestInvalidConfig(t *testing.T) {
+	for name, read := range map[string]func(*gotcp.FrameReader) (gotcp.Packet, error){
+		"empty delimiter": (&Delimiter{Decode: decodeRaw}).Read,
+		"empty end tag":   (&Tagged{Start: []byte{'<'}, Decode: decodeRaw}).Read,
+		"no start bytes":  (&Tagged{End: []byte(">"), Decode: decodeRaw}).Read,
+		"zero length":     (&FixedLength{Decode: decodeRaw}).Read,
+		"negative length": (&FixedLength{Length: -1, Decode: decodeRaw}).Read,
+	} {
+		if _, err := read(oneByte([]byte("<a>\n"))); err != ErrConfig {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestDrop(t *testing.T) {
+	d := &Delimiter{
+		Delimiter: []byte("\n"),
+		Decode: func(frame []byte) (gotcp.Packet, error) {
+			if string(frame) == "bad" {
+				return nil, ErrDrop
+			}
+			return rawPacket(frame), nil
+		},
+	}
+
+	expectFrames(t, readAll(t, d.Read, oneByte([]byte("a\nbad\nb\n"))), "a", "b")
+}
@@ -0,0 +1,70 @@
+package codec
+
+import (
+	"bytes"
+
+	"github.com/giskook/gotcp"
+)
+
+// Delimiter frames packets ending with a delimiter, such as "\r\n"
+type Delimiter struct {
+	Delimiter     []byte
+	KeepDelimiter bool // pass the delimiter to Decode
+	MaxLength     int  // the limit of a frame, 0 means 64KB
+	Decode        DecodeFunc
+}
+
+func (d *Delimiter) ReadPacket(conn *gotcp.Conn) (gotcp.Packet, error) {
+	return d.Read(conn.Reader())
+}
+
+func (d *Delimiter) Read(r *gotcp.FrameReader) (gotcp.Packet, error) {
+	if len(d.Delimiter) == 0 {
+		return nil, ErrConfig
+	}
+
+	return readPacket(r, d.readFrame)
+}
+
+func (d *Delimiter) readFrame(r *gotcp.FrameReader) (gotcp.Packet, error) {
+	limit := maxLength(d.MaxLength)
+	searched := 0
+	for {
+		index := bytes.Index(r.Bytes()[searched:], d.Delimiter)
+		if index > -1 {
+			index += searched
+			if index+len(d.Delimiter) > limit {
+				return nil, ErrFrameTooLong
+			}
+
+			if d.KeepDelimiter {
+				frame, _ := r.Next(index + len(d.Delimiter))
+				return d.Decode(frame)
+			}
+
+			frame, _ := r.Next(index)
+			r.Discard(len(d.Delimiter))
+			return d.Decode(frame)
+		}
+
+		if r.Buffered() >= limit {
+			return nil, ErrFrameTooLong
+		}
+
+		// the delimiter may straddle the bytes read next
+		if searched = r.Buffered() - len(d.Delimiter) + 1; searched < 0 {
+			searched = 0
+		}
+
+		if err := r.Fill(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Append appends the delimiter to body
+func (d *Delimiter) Append(body []byte) []byte {
+	frame := make([]byte, 0, len(body)+len(d.Delimiter))
+	frame = append(frame, body...)
+	return append(frame, d.Delimiter...)
+}
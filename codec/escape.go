@@ -0,0 +1,162 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"sync/atomic"
+
+	"github.com/giskook/gotcp"
+)
+
+var ErrInvalidEscape = errors.New("codec: invalid escape sequence")
+
+// Escape frames packets between two Delimiter bytes and byte stuffs the
+// body, so the delimiter never appears inside a frame. Every byte b of the
+// body found in Table is sent as Escape followed by Table[b]. Decode gets
+// the unescaped body, without the delimiters.
+type Escape struct {
+	Delimiter byte
+	Escape    byte
+	Table     map[byte]byte // must hold Delimiter and Escape
+	MaxLength int           // the limit of an escaped frame, 0 means 64KB
+	Decode    DecodeFunc
+
+	// OnCorrupt decides what happens to a frame with an invalid escape
+	// sequence, nil means CorruptDrop
+	OnCorrupt func(frame []byte, err error) CorruptAction
+
+	corrupt uint64 // the number of frames with an invalid escape sequence
+}
+
+// Corrupt returns the number of frames with an invalid escape sequence seen so far
+func (e *Escape) Corrupt() uint64 {
+	return atomic.LoadUint64(&e.corrupt)
+}
+
+// NewJT808Escape returns the JT/T 808 framing, 0x7E delimits the frames,
+// 0x7E is escaped as 0x7D 0x02 and 0x7D as 0x7D 0x01
+func NewJT808Escape(decode DecodeFunc) *Escape {
+	return &Escape{
+		Delimiter: 0x7E,
+		Escape:    0x7D,
+		Table:     map[byte]byte{0x7E: 0x02, 0x7D: 0x01},
+		Decode:    decode,
+	}
+}
+
+func (e *Escape) ReadPacket(conn *gotcp.Conn) (gotcp.Packet, error) {
+	return e.Read(conn.Reader())
+}
+
+func (e *Escape) Read(r *gotcp.FrameReader) (gotcp.Packet, error) {
+	return readPacket(r, e.readFrame)
+}
+
+func (e *Escape) readFrame(r *gotcp.FrameReader) (gotcp.Packet, error) {
+	limit := maxLength(e.MaxLength)
+	for {
+		head, err := r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if head[0] != e.Delimiter { // not a frame start, resync on the next byte
+			r.Discard(1)
+			continue
+		}
+
+		searched := 1
+		for {
+			index := bytes.IndexByte(r.Bytes()[searched:], e.Delimiter)
+			if index > -1 {
+				searched += index
+				break
+			}
+			if searched = r.Buffered(); searched >= limit {
+				return nil, ErrFrameTooLong
+			}
+			if err := r.Fill(); err != nil {
+				return nil, err
+			}
+		}
+
+		if searched == 1 { // two delimiters in a row, the second one starts the frame
+			r.Discard(1)
+			continue
+		}
+
+		frame, _ := r.Next(searched + 1)
+		body, err := e.Unescape(frame[1:searched])
+		if err != nil {
+			// the frame is consumed already, the next one is read unless told otherwise
+			atomic.AddUint64(&e.corrupt, 1)
+			if e.OnCorrupt != nil && e.OnCorrupt(frame, err) == CorruptClose {
+				return nil, err
+			}
+			return nil, ErrDrop
+		}
+
+		return e.Decode(body)
+	}
+}
+
+// Unescape reverts the byte stuffing of an escaped body
+func (e *Escape) Unescape(escaped []byte) ([]byte, error) {
+	body := make([]byte, 0, len(escaped))
+	for i := 0; i < len(escaped); i++ {
+		b := escaped[i]
+		if b != e.Escape {
+			body = append(body, b)
+			continue
+		}
+
+		if i++; i == len(escaped) {
+			return nil, ErrInvalidEscape
+		}
+		original, ok := e.original(escaped[i])
+		if !ok {
+			return nil, ErrInvalidEscape
+		}
+		body = append(body, original)
+	}
+
+	return body, nil
+}
+
+func (e *Escape) original(code byte) (byte, bool) {
+	for b, c := range e.Table {
+		if c == code {
+			return b, true
+		}
+	}
+
+	return 0, false
+}
+
+// Encode byte stuffs body and wraps it with the delimiters
+func (e *Escape) Encode(body []byte) []byte {
+	frame := make([]byte, 0, len(body)+len(body)/8+2)
+	frame = append(frame, e.Delimiter)
+	for _, b := range body {
+		if code, ok := e.Table[b]; ok {
+			frame = append(frame, e.Escape, code)
+		} else {
+			frame = append(frame, b)
+		}
+	}
+
+	return append(frame, e.Delimiter)
+}
+
+// Wrap returns p serialized as an escaped frame
+func (e *Escape) Wrap(p gotcp.Packet) gotcp.Packet {
+	return &escapedPacket{escape: e, packet: p}
+}
+
+type escapedPacket struct {
+	escape *Escape
+	packet gotcp.Packet
+}
+
+func (p *escapedPacket) Serialize() []byte {
+	return p.escape.Encode(p.packet.Serialize())
+}
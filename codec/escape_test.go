@@ -0,0 +1,75 @@
+package codec
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestJT808Escape(t *testing.T) {
+	e := NewJT808Escape(decodeRaw)
+
+	body := []byte{0x30, 0x7E, 0x08, 0x7D, 0x55}
+	frame := e.Encode(body)
+	expected := []byte{0x7E, 0x30, 0x7D, 0x02, 0x08, 0x7D, 0x01, 0x55, 0x7E}
+	if !bytes.Equal(frame, expected) {
+		t.Fatalf("encoded % X, expected % X", frame, expected)
+	}
+
+	p, err := e.Read(oneByte(frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Serialize(); !bytes.Equal(got, body) {
+		t.Fatalf("decoded % X, expected % X", got, body)
+	}
+}
+
+func TestEscapeResync(t *testing.T) {
+	e := NewJT808Escape(decodeRaw)
+
+	// garbage before the first frame, then two delimiters in a row
+	stream := []byte{0x01, 0x02, 0x7E, 0x11, 0x7E, 0x7E, 0x22, 0x7E}
+	expectFrames(t, readAll(t, e.Read, oneByte(stream)), "\x11", "\x22")
+}
+
+func TestEscapeInvalid(t *testing.T) {
+	invalid := [][]byte{
+		{0x7E, 0x11, 0x7D, 0x7E},       // an escape ending the body
+		{0x7E, 0x11, 0x7D, 0x03, 0x7E}, // an unknown escape code
+	}
+
+	// the corrupt frames are dropped and counted, the session goes on
+	e := NewJT808Escape(decodeRaw)
+	var stream []byte
+	for _, frame := range invalid {
+		stream = append(stream, frame...)
+	}
+	stream = append(stream, 0x7E, 0x22, 0x7E)
+	expectFrames(t, readAll(t, e.Read, oneByte(stream)), "\x22")
+	if e.Corrupt() != 2 {
+		t.Fatalf("%d corrupt frames", e.Corrupt())
+	}
+
+	var seen []byte
+	e.OnCorrupt = func(frame []byte, err error) CorruptAction {
+		seen = frame
+		return CorruptClose
+	}
+	for _, frame := range invalid {
+		if _, err := e.Read(oneByte(frame)); err != ErrInvalidEscape || !bytes.Equal(seen, frame) {
+			t.Fatalf("% X: %v, OnCorrupt got % X", frame, err, seen)
+		}
+	}
+}
+
+func TestEscapeLimit(t *testing.T) {
+	e := NewJT808Escape(decodeRaw)
+	e.MaxLength = 4
+
+	if _, err := e.Read(oneByte([]byte{0x7E, 0x11, 0x22, 0x7E})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Read(oneByte([]byte{0x7E, 0x11, 0x22, 0x33, 0x44, 0x7E})); err != ErrFrameTooLong {
+		t.Fatalf("frame over the limit: %v", err)
+	}
+}
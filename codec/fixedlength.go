@@ -0,0 +1,32 @@
+package codec
+
+import (
+	"github.com/giskook/gotcp"
+)
+
+// FixedLength frames packets of Length bytes
+type FixedLength struct {
+	Length int
+	Decode DecodeFunc
+}
+
+func (f *FixedLength) ReadPacket(conn *gotcp.Conn) (gotcp.Packet, error) {
+	return f.Read(conn.Reader())
+}
+
+func (f *FixedLength) Read(r *gotcp.FrameReader) (gotcp.Packet, error) {
+	if f.Length <= 0 {
+		return nil, ErrConfig
+	}
+
+	return readPacket(r, f.readFrame)
+}
+
+func (f *FixedLength) readFrame(r *gotcp.FrameReader) (gotcp.Packet, error) {
+	frame, err := r.Next(f.Length)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.Decode(frame)
+}
@@ -0,0 +1,112 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/giskook/gotcp"
+)
+
+// LengthField frames packets by a length field in the header, like
+//
+//	| header | length | header | body |
+//	 Offset   Size
+//
+// The frame is Offset+Size+length+Adjustment bytes long, length being the
+// value of the field. A length field counting the whole frame has a
+// negative Adjustment. Strip bytes are cut off the frame before Decode.
+type LengthField struct {
+	Offset     int              // the offset of the length field
+	Size       int              // the size of the length field, 1, 2, 4 or 8
+	ByteOrder  binary.ByteOrder // the byte order of the length field, big endian if nil
+	Adjustment int              // added to the length to get the bytes after the field
+	Strip      int              // the bytes stripped from the start of the frame
+	MaxLength  int              // the limit of a frame, 0 means 64KB
+	Decode     DecodeFunc
+}
+
+func (l *LengthField) ReadPacket(conn *gotcp.Conn) (gotcp.Packet, error) {
+	return l.Read(conn.Reader())
+}
+
+func (l *LengthField) Read(r *gotcp.FrameReader) (gotcp.Packet, error) {
+	return readPacket(r, l.readFrame)
+}
+
+func (l *LengthField) readFrame(r *gotcp.FrameReader) (gotcp.Packet, error) {
+	header, err := r.Peek(l.Offset + l.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	length, err := l.length(header[l.Offset:])
+	if err != nil {
+		return nil, err
+	}
+
+	total := int64(l.Offset+l.Size+l.Adjustment) + length
+	if total < int64(l.Offset+l.Size) || total < int64(l.Strip) {
+		return nil, errors.New("codec: invalid length field")
+	}
+	if total > int64(maxLength(l.MaxLength)) {
+		return nil, ErrFrameTooLong
+	}
+
+	frame, err := r.Next(int(total))
+	if err != nil {
+		return nil, err
+	}
+
+	return l.Decode(frame[l.Strip:])
+}
+
+func (l *LengthField) length(field []byte) (int64, error) {
+	order := l.ByteOrder
+	if order == nil {
+		order = binary.BigEndian
+	}
+
+	switch l.Size {
+	case 1:
+		return int64(field[0]), nil
+	case 2:
+		return int64(order.Uint16(field)), nil
+	case 4:
+		return int64(order.Uint32(field)), nil
+	case 8:
+		length := order.Uint64(field)
+		if length > 1<<62 {
+			return 0, ErrFrameTooLong
+		}
+		return int64(length), nil
+	}
+
+	return 0, errors.New("codec: unsupported length field size")
+}
+
+// AppendLength prepends the length field to body as Read expects it, with
+// header being the Offset bytes in front of the field
+func (l *LengthField) AppendLength(header, body []byte) []byte {
+	order := l.ByteOrder
+	if order == nil {
+		order = binary.BigEndian
+	}
+
+	length := uint64(len(body) - l.Adjustment)
+	field := make([]byte, l.Size)
+	switch l.Size {
+	case 1:
+		field[0] = byte(length)
+	case 2:
+		order.PutUint16(field, uint16(length))
+	case 4:
+		order.PutUint32(field, uint32(length))
+	case 8:
+		order.PutUint64(field, length)
+	}
+
+	frame := make([]byte, 0, len(header)+l.Size+len(body))
+	frame = append(frame, header...)
+	frame = append(frame, field...)
+	return append(frame, body...)
+}
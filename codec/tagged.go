@@ -0,0 +1,116 @@
+package codec
+
+import (
+	"bytes"
+
+	"github.com/giskook/gotcp"
+)
+
+// Tagged frames packets starting with a start tag and ending with an end
+// tag, like "type byte + body + end tag". Bytes that do not start a frame
+// are skipped, so the stream resyncs after garbage.
+type Tagged struct {
+	Start []byte // a frame starts with any one of these bytes
+	End   []byte // the end tag
+
+	// Length returns the fixed frame length, tags included, of a frame
+	// starting with start. The end tag is then only checked at the end of
+	// the frame, so it may appear in the body. If Length is nil or returns
+	// 0 the frame ends at the first end tag.
+	Length func(start byte) int
+
+	StripTags bool // pass only the body to Decode
+	MaxLength int  // the limit of a frame, 0 means 64KB
+	Decode    DecodeFunc
+}
+
+func (t *Tagged) ReadPacket(conn *gotcp.Conn) (gotcp.Packet, error) {
+	return t.Read(conn.Reader())
+}
+
+func (t *Tagged) Read(r *gotcp.FrameReader) (gotcp.Packet, error) {
+	if len(t.Start) == 0 || len(t.End) == 0 {
+		return nil, ErrConfig
+	}
+
+	return readPacket(r, t.readFrame)
+}
+
+func (t *Tagged) readFrame(r *gotcp.FrameReader) (gotcp.Packet, error) {
+	limit := maxLength(t.MaxLength)
+	for {
+		head, err := r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+
+		if bytes.IndexByte(t.Start, head[0]) < 0 { // not a frame start, resync on the next byte
+			r.Discard(1)
+			continue
+		}
+
+		length := 0
+		if t.Length != nil {
+			length = t.Length(head[0])
+		}
+
+		if length > 0 {
+			frame, err := r.Peek(length)
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.HasSuffix(frame, t.End) {
+				r.Discard(1)
+				continue
+			}
+		} else if length, err = t.scanEnd(r, limit); err != nil {
+			return nil, err
+		} else if length == 0 {
+			r.Discard(1)
+			continue
+		}
+
+		frame, _ := r.Next(length)
+		if t.StripTags {
+			frame = frame[1 : len(frame)-len(t.End)]
+		}
+
+		return t.Decode(frame)
+	}
+}
+
+// scanEnd returns the length of the frame ending with the first end tag
+// after the start byte, 0 if it is longer than limit
+func (t *Tagged) scanEnd(r *gotcp.FrameReader, limit int) (int, error) {
+	searched := 1
+	for {
+		index := bytes.Index(r.Bytes()[searched:], t.End)
+		if index > -1 {
+			length := searched + index + len(t.End)
+			if length > limit {
+				return 0, nil
+			}
+			return length, nil
+		}
+
+		if r.Buffered() >= limit {
+			return 0, nil
+		}
+
+		if searched = r.Buffered() - len(t.End) + 1; searched < 1 {
+			searched = 1
+		}
+
+		if err := r.Fill(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Append wraps body with the start byte start and the end tag
+func (t *Tagged) Append(start byte, body []byte) []byte {
+	frame := make([]byte, 0, 1+len(body)+len(t.End))
+	frame = append(frame, start)
+	frame = append(frame, body...)
+	return append(frame, t.End...)
+}
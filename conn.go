@@ -1,42 +1,70 @@
 package gotcp
 
 import (
-	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"net"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/giskook/gotcp/envelope"
 )
 
 // Error type
 var (
-	ErrConnClosing   = errors.New("use of closed network connection")
-	ErrWriteBlocking = errors.New("write packet was blocking")
-	ErrReadBlocking  = errors.New("read packet was blocking")
-	ErrReadHalf      = errors.New("read half packet")
+	ErrConnClosing    = errors.New("use of closed network connection")
+	ErrWriteBlocking  = errors.New("write packet was blocking")
+	ErrReadBlocking   = errors.New("read packet was blocking")
+	ErrReadHalf       = errors.New("read half packet")
+	ErrServerShutdown = errors.New("server shutdown")
+	ErrLoginTakenOver = errors.New("device logged in on another connection")
 )
 
 // Conn exposes a set of callbacks for the various events that occur on a connection
 type Conn struct {
 	srv               *Server
-	conn              *net.TCPConn  // the raw connection
-	extraData         interface{}   // to save extra data
-	closeOnce         sync.Once     // close the conn, once, per instance
-	closeFlag         int32         // close flag
-	closeChan         chan struct{} // close chanel
-	packetSendChan    chan Packet   // packet send chanel
-	packetReceiveChan chan Packet   // packeet receive chanel
-
-	packetNsqReceiveChan chan Packet // packet receive nsq chanel
-	//cmdbufferChan        chan byte
-	recieveBuffer *bytes.Buffer
+	conn              net.Conn                   // the raw connection
+	extraData         interface{}                // to save extra data
+	closeOnce         sync.Once                  // close the conn, once, per instance
+	closeFlag         int32                      // close flag
+	closeReason       CloseReason                // why the conn was closed
+	closeChan         chan struct{}              // close chanel
+	packetSendChans   [priorityLanes]chan Packet // packet send chanels, one per Priority
+	packetReceiveChan chan receivedPacket        // packeet receive chanel
+
+	reader *FrameReader // the read buffer, used by readLoop only
+
+	peerCert     *x509.Certificate // the verified client certificate
+	peerIdentity string            // the identity derived from peerCert
+
+	index uint64
+	topic string
+	mac   string
+
+	start        time.Time // when the conn was accepted
+	presenceFlag int32     // the accepted presence event was published
+	receivedAt   int64     // unix nano the packet being handled was read, accessed atomically
+
+	lastRead  int64       // unix nano of the last read, accessed atomically
+	lastWrite int64       // unix nano of the last write, accessed atomically
+	idleLock  sync.Mutex  // guards idleTimer
+	idleTimer *wheelTimer // the pending idle check
+	idleFired [3]int64    // unix nano each IdleState last fired, used by checkIdle only
+
+	writeWait  sync.WaitGroup // wait for the writer to flush on shutdown
+	writeStats writeCounters  // counters of the writer
+	encodeBuf  []byte         // the buffer Encoder packets are encoded into, used by the writer only
+
+	requestLock sync.Mutex
+	requests    map[interface{}]*Future // pending requests by correlation key
+}
 
-	index    uint32
-	topic    string
-	mac      string
-	timeflag int64
-	ticker   *time.Ticker
+// receivedPacket is a packet with the unix nano it was read at
+type receivedPacket struct {
+	p  Packet
+	at int64
 }
 
 // ConnCallback is an interface of methods that are used as callbacks on a connection
@@ -53,22 +81,32 @@ type ConnCallback interface {
 	OnClose(*Conn)
 }
 
+// ErrorCallback is an optional interface of ConnCallback, OnError is called
+// with the errors that do not close the connection, such as *EncodeError
+type ErrorCallback interface {
+	OnError(*Conn, error)
+}
+
 // newConn returns a wrapper of raw conn
-func newConn(conn *net.TCPConn, srv *Server, index uint32) *Conn {
-	return &Conn{
-		srv:                  srv,
-		conn:                 conn,
-		closeChan:            make(chan struct{}),
-		packetSendChan:       make(chan Packet, srv.config.PacketSendChanLimit),
-		packetReceiveChan:    make(chan Packet, srv.config.PacketReceiveChanLimit),
-		packetNsqReceiveChan: make(chan Packet, 64),
-		//cmdbufferChan:        make(chan byte, 1024),
-		recieveBuffer: bytes.NewBuffer([]byte{}),
-
-		index:    index,
-		timeflag: time.Now().Unix(),
-		ticker:   time.NewTicker(60),
+func newConn(conn net.Conn, srv *Server, index uint64) *Conn {
+	now := time.Now().UnixNano()
+	c := &Conn{
+		srv:               srv,
+		conn:              conn,
+		closeChan:         make(chan struct{}),
+		packetReceiveChan: make(chan receivedPacket, srv.config.PacketReceiveChanLimit),
+		reader:            newFrameReader(conn, srv.config.MaxFrameSize),
+
+		index:     index,
+		start:     time.Unix(0, now),
+		lastRead:  now,
+		lastWrite: now,
 	}
+	for i := range c.packetSendChans {
+		c.packetSendChans[i] = make(chan Packet, srv.config.PacketSendChanLimit)
+	}
+
+	return c
 }
 
 // GetExtraData gets the extra data from the Conn
@@ -81,30 +119,131 @@ func (c *Conn) PutExtraData(data interface{}) {
 	c.extraData = data
 }
 
-func (c *Conn) GetRecvBytes() *bytes.Buffer {
-	return c.recieveBuffer
+// Reader returns the read buffer of the Conn, it must only be used by
+// Protocol.ReadPacket
+func (c *Conn) Reader() *FrameReader {
+	return c.reader
 }
 
-// GetRawConn returns the raw net.TCPConn from the Conn
+// GetRawConn returns the raw net.TCPConn from the Conn, under TLS the one
+// the TLS conn runs over, writes to it then bypass TLS. It returns nil if
+// the Conn was not accepted from a TCP listener.
 func (c *Conn) GetRawConn() *net.TCPConn {
+	conn := c.conn
+	if tlsConn, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = tlsConn.NetConn()
+	}
+
+	tcpConn, _ := conn.(*net.TCPConn)
+	return tcpConn
+}
+
+// NetConn returns the underlying net.Conn from the Conn
+func (c *Conn) NetConn() net.Conn {
 	return c.conn
 }
 
+// PeerCertificate returns the verified client certificate,
+// nil if the conn is not TLS or the client was not verified
+func (c *Conn) PeerCertificate() *x509.Certificate {
+	return c.peerCert
+}
+
+// PeerIdentity returns the identity derived from the verified client
+// certificate by Config.PeerIdentity, "" if there is none. Unlike an ID
+// carried in a payload it can be trusted to bind the conn with SetID.
+func (c *Conn) PeerIdentity() string {
+	return c.peerIdentity
+}
+
+// handshake runs the TLS handshake and records the verified peer identity
+func (c *Conn) handshake() error {
+	tlsConn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	timeout := c.srv.config.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	defer tlsConn.SetDeadline(time.Time{})
+
+	// a silent client must not hold up Shutdown until the deadline
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-c.srv.exitChan:
+			tlsConn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 0 {
+		c.peerCert = state.VerifiedChains[0][0]
+
+		identity := c.srv.config.PeerIdentity
+		if identity == nil {
+			identity = CertIdentity
+		}
+		c.peerIdentity = identity(c.peerCert)
+	}
+
+	return nil
+}
+
 // Close closes the connection
 func (c *Conn) Close() {
+	c.close(CloseReason{Kind: CloseLocal})
+}
+
+// close closes the connection and records reason, unless it was closed already
+func (c *Conn) close(reason CloseReason) {
 	c.closeOnce.Do(func() {
+		c.closeReason = reason
 		atomic.StoreInt32(&c.closeFlag, 1)
+		// the packet chanels are left open, foreign goroutines may still
+		// be sending to them, the loops stop on closeChan instead
 		close(c.closeChan)
-		close(c.packetSendChan)
-		close(c.packetReceiveChan)
-		close(c.packetNsqReceiveChan)
-		//	close(c.cmdbufferChan)
 		c.conn.Close()
-		c.srv.mqhub.RemoveConn(c.index, c.mac)
-		c.srv.callback.OnClose(c)
+		c.stopIdle()
+		c.failRequests(ErrConnClosing)
+		// the ID of a conn that was taken over is bound to another conn
+		// now, the closed event must not claim it went offline
+		closed := &Presence{Reason: reason.String()}
+		id := c.ID()
+		if owner, _ := c.srv.registry.Lookup(id); id != "" && owner != c {
+			id = ""
+			closed.TakenOver = true
+		}
+		c.srv.registry.Remove(c)
+		c.publishPresence(PresenceClosed, id, closed)
+		if cb, ok := c.srv.callback.(CloseReasonCallback); ok {
+			cb.OnCloseReason(c, reason)
+		} else {
+			c.srv.callback.OnClose(c)
+		}
 	})
 }
 
+// CloseReason returns why the connection was closed, only meaningful once closed
+func (c *Conn) CloseReason() CloseReason {
+	return c.closeReason
+}
+
+// CloseError returns the error the connection was closed with, such as
+// ErrServerShutdown when it was closed by Server.Shutdown, nil if none
+func (c *Conn) CloseError() error {
+	return c.closeReason.Err
+}
+
 // IsClosed indicates whether or not the connection is closed
 func (c *Conn) IsClosed() bool {
 	return atomic.LoadInt32(&c.closeFlag) == 1
@@ -118,6 +257,8 @@ func (c *Conn) SetMac(mac string) {
 	c.mac = mac
 }
 
+// GetTopic returns the topic set by SetTopic, it is left to the callbacks,
+// Subscribe replies to the topic of each Downstream instead
 func (c *Conn) GetTopic() string {
 	return c.topic
 }
@@ -126,10 +267,45 @@ func (c *Conn) SetTopic(topic string) {
 	c.topic = topic
 }
 
-func (c *Conn) Send(topic string, value []byte) bool {
-	c.srv.mqhub.Send(topic, value)
+// Send publishes value to topic through the mqhub of the server,
+// ErrNoBroker if it has none
+func (c *Conn) Send(topic string, value []byte) error {
+	if c.srv.mqhub == nil {
+		return ErrNoBroker
+	}
+
+	return c.srv.mqhub.Send(topic, value)
+}
+
+// ReceivedAt returns when the packet being handled was read, that is the
+// last packet handed to the pipeline or returned by AsyncReadPacket
+func (c *Conn) ReceivedAt() time.Time {
+	if at := atomic.LoadInt64(&c.receivedAt); at != 0 {
+		return time.Unix(0, at)
+	}
 
-	return true
+	return time.Now()
+}
+
+// Publish publishes an envelope of payload, received from the conn at
+// ReceivedAt, to topic through the mqhub of the server, ErrNoBroker if it has none
+func (c *Conn) Publish(topic string, eventType string, payload []byte) error {
+	if c.srv.mqhub == nil {
+		return ErrNoBroker
+	}
+
+	e := &envelope.Envelope{
+		DeviceID: c.ID(),
+		ConnID:   c.index,
+		Time:     c.ReceivedAt(),
+		Type:     eventType,
+		Payload:  payload,
+	}
+	if addr := c.conn.RemoteAddr(); addr != nil {
+		e.RemoteAddr = addr.String()
+	}
+
+	return c.srv.mqhub.Publish(topic, e)
 }
 
 // AsyncReadPacket async reads a packet, this method will never block
@@ -140,8 +316,9 @@ func (c *Conn) AsyncReadPacket(timeout time.Duration) (Packet, error) {
 
 	if timeout == 0 {
 		select {
-		case p := <-c.packetReceiveChan:
-			return p, nil
+		case r := <-c.packetReceiveChan:
+			atomic.StoreInt64(&c.receivedAt, r.at)
+			return r.p, nil
 
 		default:
 			return nil, ErrReadBlocking
@@ -149,8 +326,9 @@ func (c *Conn) AsyncReadPacket(timeout time.Duration) (Packet, error) {
 
 	} else {
 		select {
-		case p := <-c.packetReceiveChan:
-			return p, nil
+		case r := <-c.packetReceiveChan:
+			atomic.StoreInt64(&c.receivedAt, r.at)
+			return r.p, nil
 
 		case <-c.closeChan:
 			return nil, ErrConnClosing
@@ -161,103 +339,118 @@ func (c *Conn) AsyncReadPacket(timeout time.Duration) (Packet, error) {
 	}
 }
 
-// AsyncWritePacket async writes a packet, this method will never block
+// AsyncWritePacket async writes a packet with PriorityControl, this method will never block
 func (c *Conn) AsyncWritePacket(p Packet, timeout time.Duration) error {
-	if c.IsClosed() {
-		return ErrConnClosing
-	}
-
-	if timeout == 0 {
-		select {
-		case c.packetSendChan <- p:
-			return nil
-
-		default:
-			return ErrWriteBlocking
-		}
-
-	} else {
-		select {
-		case c.packetSendChan <- p:
-			return nil
+	return c.WritePacket(p, PriorityControl, timeout)
+}
 
-		case <-c.closeChan:
-			return ErrConnClosing
+// NsqWritePacket async writes a packet with PriorityBroker, this method will never block
+func (c *Conn) NsqWritePacket(p Packet, timeout time.Duration) error {
+	return c.WritePacket(p, PriorityBroker, timeout)
+}
 
-		case <-time.After(timeout):
-			return ErrWriteBlocking
+// SetID binds the device ID mac to the conn registered under index,
+// lookups by mac then resolve to it until it closes or mac is rebound.
+// If mac is bound to another live conn, Config.DuplicateLogin applies.
+func (c *Conn) SetID(mac string, index uint64) error {
+	target := c
+	if index != c.index {
+		if target = c.srv.registry.Get(index); target == nil {
+			return ErrConnNotFound
 		}
 	}
-}
 
-func (c *Conn) NsqWritePacket(p Packet, timeout time.Duration) error {
-	if c.IsClosed() {
-		return ErrConnClosing
+	policy := c.srv.config.DuplicateLogin
+	old, _, err := c.srv.registry.Bind(mac, target, policy != DuplicateRejectNew)
+	if err != nil && err != ErrDuplicateLogin {
+		return err
 	}
 
-	if timeout == 0 {
-		select {
-		case c.packetNsqReceiveChan <- p:
-			return nil
-
-		default:
-			return ErrWriteBlocking
+	if err == nil && old != target {
+		if old == nil {
+			target.publishPresence(PresenceBound, mac, &Presence{})
+		} else {
+			target.publishPresence(PresenceRebound, mac, &Presence{Previous: old.index})
 		}
+	}
 
-	} else {
-		select {
-		case c.packetNsqReceiveChan <- p:
-			return nil
+	if old == nil || old == target {
+		return nil
+	}
 
-		case <-c.closeChan:
-			return ErrConnClosing
+	if policy == DuplicateKickOld {
+		old.close(CloseReason{Kind: CloseTakenOver, Err: ErrLoginTakenOver})
+	}
 
-		case <-time.After(timeout):
-			return ErrWriteBlocking
-		}
+	if cb, ok := c.srv.callback.(DuplicateLoginCallback); ok {
+		cb.OnDuplicateLogin(&DuplicateLogin{
+			ID:     mac,
+			Old:    old,
+			New:    target,
+			Policy: policy,
+		})
 	}
-}
 
-func (c *Conn) SetID(mac string, index uint32) error {
-	c.srv.mqhub.connsmac[mac] = index
+	return err
+}
 
-	return nil
+// ID returns the device ID last bound to the conn, "" if none. After a
+// duplicate login it may be bound to another conn, see Registry.GetByID.
+func (c *Conn) ID() string {
+	return c.srv.registry.idOf(c)
 }
 
-func (c *Conn) GetIndex() uint32 {
+// GetIndex returns the connection index, unique for the lifetime of the registry
+func (c *Conn) GetIndex() uint64 {
 	return c.index
 }
 
+// SetTimeFlag marks the conn as read at the unix time timeflag, packets
+// read by the Protocol already do so
 func (c *Conn) SetTimeFlag(timeflag int64) {
-	c.timeflag = timeflag
+	atomic.StoreInt64(&c.lastRead, time.Unix(timeflag, 0).UnixNano())
 }
 
 // Do it
 func (c *Conn) Do() {
+	if err := c.handshake(); err != nil {
+		c.close(CloseReason{Kind: CloseHandshake, Err: err})
+		return
+	}
+
+	c.publishPresence(PresenceAccepted, "", &Presence{})
+
 	if !c.srv.callback.OnConnect(c) {
+		// the conn is registered already, closing it also removes it
+		c.close(CloseReason{Kind: CloseRejected, Err: ErrRejected})
 		return
 	}
 
+	c.srv.waitGroup.Add(3)
+	c.writeWait.Add(1)
 	go c.handleLoop()
 	go c.readLoop()
 	go c.writeLoop()
-	go c.writeToclientLoop()
-	go c.checkHeart()
+
+	if c.srv.wheel != nil {
+		c.scheduleIdle(c.srv.wheel.interval)
+	}
 }
 
+// readLoop keeps reading until the conn is closed, on shutdown the
+// conn is closed by handleLoop once the writers are flushed
 func (c *Conn) readLoop() {
-	c.srv.waitGroup.Add(1)
 	defer func() {
-		recover()
+		if r := recover(); r != nil {
+			c.close(panicReason(r))
+		}
 		c.Close()
+		c.reader.release()
 		c.srv.waitGroup.Done()
 	}()
 
 	for {
 		select {
-		case <-c.srv.exitChan:
-			return
-
 		case <-c.closeChan:
 			return
 
@@ -267,33 +460,15 @@ func (c *Conn) readLoop() {
 		p, err := c.srv.protocol.ReadPacket(c)
 
 		if err != nil && err != ErrReadHalf {
+			c.close(readReason(err))
 			return
 		}
 
 		if err != ErrReadHalf {
-			c.packetReceiveChan <- p
-		}
-	}
-}
-
-func (c *Conn) writeLoop() {
-	c.srv.waitGroup.Add(1)
-	defer func() {
-		recover()
-		c.Close()
-		c.srv.waitGroup.Done()
-	}()
-
-	for {
-		select {
-		case <-c.srv.exitChan:
-			return
-
-		case <-c.closeChan:
-			return
-
-		case p := <-c.packetSendChan:
-			if _, err := c.conn.Write(p.Serialize()); err != nil {
+			at := c.touchRead()
+			select {
+			case c.packetReceiveChan <- receivedPacket{p: p, at: at}:
+			case <-c.closeChan:
 				return
 			}
 		}
@@ -301,33 +476,10 @@ func (c *Conn) writeLoop() {
 }
 
 func (c *Conn) handleLoop() {
-	c.srv.waitGroup.Add(1)
 	defer func() {
-		recover()
-		c.Close()
-		c.srv.waitGroup.Done()
-	}()
-
-	for {
-		select {
-		case <-c.srv.exitChan:
-			return
-
-		case <-c.closeChan:
-			return
-
-		case p := <-c.packetReceiveChan:
-			if !c.srv.callback.OnMessage(c, p) {
-				return
-			}
+		if r := recover(); r != nil {
+			c.close(panicReason(r))
 		}
-	}
-}
-
-func (c *Conn) writeToclientLoop() {
-	c.srv.waitGroup.Add(1)
-	defer func() {
-		recover()
 		c.Close()
 		c.srv.waitGroup.Done()
 	}()
@@ -335,31 +487,23 @@ func (c *Conn) writeToclientLoop() {
 	for {
 		select {
 		case <-c.srv.exitChan:
+			c.writeWait.Wait()
+			c.close(CloseReason{Kind: CloseShutdown, Err: ErrServerShutdown})
 			return
 
 		case <-c.closeChan:
 			return
 
-		case p := <-c.packetNsqReceiveChan:
-			if _, err := c.conn.Write(p.Serialize()); err != nil {
+		case r := <-c.packetReceiveChan:
+			atomic.StoreInt64(&c.receivedAt, r.at)
+			if err := c.srv.pipeline.read(c, 0, r.p); err != nil {
+				if err == ErrRejected {
+					c.close(CloseReason{Kind: CloseRejected, Err: ErrRejected})
+				} else {
+					c.close(CloseReason{Kind: CloseHandler, Err: err})
+				}
 				return
 			}
 		}
 	}
 }
-
-func (c *Conn) checkHeart() {
-	c.srv.waitGroup.Add(1)
-	defer func() {
-		recover()
-		c.Close()
-		c.srv.waitGroup.Done()
-	}()
-	for {
-		<-c.ticker.C
-		now := time.Now().Unix()
-		if now-c.timeflag > 600 {
-			return
-		}
-	}
-}
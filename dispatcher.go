@@ -0,0 +1,471 @@
+package gotcp
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/giskook/gotcp/envelope"
+)
+
+const (
+	// defaultCommandTimeout is how long an attempt waits for its ack when DispatcherConfig.Timeout is 0
+	defaultCommandTimeout = time.Second
+	// defaultOutcomeType is the Type of the outcome envelopes when DispatcherConfig.EventType is ""
+	defaultOutcomeType = "outcome"
+)
+
+var (
+	ErrDeviceOffline  = errors.New("device offline")
+	ErrCommandExpired = errors.New("command expired")
+)
+
+// CommandStatus is the definitive status of a dispatched command
+type CommandStatus int
+
+const (
+	CommandSuccess CommandStatus = iota // the device acked the command
+	CommandFailure                      // the device acked a failure or the command could not be sent
+	CommandTimeout                      // no ack after every retry
+	CommandOffline                      // the device was not connected by the last attempt
+	CommandExpired                      // the device did not log in before the queued command expired
+)
+
+func (s CommandStatus) String() string {
+	switch s {
+	case CommandSuccess:
+		return "success"
+	case CommandFailure:
+		return "failure"
+	case CommandTimeout:
+		return "timeout"
+	case CommandOffline:
+		return "offline"
+	case CommandExpired:
+		return "expired"
+	}
+
+	return "unknown"
+}
+
+// Command is a packet to deliver to a device, the packet and its ack
+// must share a correlation key, see Conn.Request
+type Command struct {
+	ID       string // identifies the command in its outcome
+	DeviceID string // the device ID the target conn is bound to
+	Packet   Packet
+	Topic    string // where the outcome is published, DispatcherConfig.Topic if ""
+	Payload  []byte // the broker message of the command, required to queue it offline
+}
+
+// Outcome is the definitive result of a command
+type Outcome struct {
+	Command  *Command
+	Status   CommandStatus
+	Response Packet // the ack of the device, nil unless it answered
+	Attempts int    // the number of times the command was sent
+	Err      error  // the error of the last attempt
+
+	Conn       *Conn     // the conn of the last attempt, nil if the device was offline
+	ReceivedAt time.Time // when the ack was read, zero without one
+}
+
+type DispatcherConfig struct {
+	Timeout time.Duration // how long to wait for the ack of an attempt, 1s if 0
+	Retries int           // the retransmissions after the first attempt
+	Topic   string        // the default outcome topic, no publish if ""
+
+	Ack       func(resp Packet) bool // tells success from failure acks, every ack is a success if nil
+	Encode    func(*Outcome) []byte  // the payload of the outcome envelope, JSON if nil, no publish if it returns nil
+	EventType string                 // the Type of the outcome envelopes, "outcome" if ""
+	OnOutcome func(*Outcome)         // called with every outcome, may be nil
+
+	Queue    OfflineQueue                           // holds the commands of offline devices, they fail with CommandOffline if nil
+	QueueTTL time.Duration                          // how long a command stays queued, forever if 0
+	Decode   func(payload []byte) (*Command, error) // rebuilds a queued command from its Payload
+}
+
+// Dispatcher delivers commands to devices, it retransmits a command until
+// the device acks it or the retries run out, and publishes the outcome
+type Dispatcher struct {
+	config *DispatcherConfig
+	mqhub  *Mqhub
+
+	pendingLock sync.Mutex
+	pending     map[*Command]struct{}
+
+	workerLock sync.Mutex
+	workers    map[string]bool // the devices with a queue worker, true if it must look at the queue again
+
+	exitChan chan struct{}
+	exitOnce sync.Once
+}
+
+// NewDispatcher creates a dispatcher resolving devices through the
+// registry of mqhub and publishing outcomes with it. With a Queue, the
+// commands of a device go through its queue and are delivered one after
+// another, the ones queued while it was offline once its ID is bound.
+func NewDispatcher(config *DispatcherConfig, mqhub *Mqhub) *Dispatcher {
+	d := &Dispatcher{
+		config:   config,
+		mqhub:    mqhub,
+		pending:  make(map[*Command]struct{}),
+		workers:  make(map[string]bool),
+		exitChan: make(chan struct{}),
+	}
+
+	if config.Queue != nil {
+		mqhub.Registry().OnBind(func(id string, c *Conn) {
+			d.startWorker(id)
+		})
+		if config.QueueTTL > 0 {
+			go d.expireLoop()
+		}
+	}
+
+	return d
+}
+
+// Stop stops expiring the queued commands and closes the Queue
+func (d *Dispatcher) Stop() error {
+	d.exitOnce.Do(func() {
+		close(d.exitChan)
+	})
+
+	if d.config.Queue != nil {
+		return d.config.Queue.Close()
+	}
+
+	return nil
+}
+
+// Dispatch starts delivering cmd, the outcome is reported asynchronously.
+// With a Queue, cmd is queued behind the commands of its device and kept
+// until the device logs in if it is offline. Otherwise, or if it can not
+// be queued, a command for a device that is not connected fails with
+// CommandOffline.
+func (d *Dispatcher) Dispatch(cmd *Command) {
+	if d.config.Queue != nil && cmd.Payload != nil && d.config.Decode != nil {
+		if err := d.enqueue(cmd); err != nil {
+			status := CommandFailure
+			if d.mqhub.Registry().GetByID(cmd.DeviceID) == nil {
+				status = CommandOffline
+			}
+			d.finish(&Outcome{Command: cmd, Status: status, Err: err})
+			return
+		}
+
+		d.startWorker(cmd.DeviceID)
+		return
+	}
+
+	if d.mqhub.Registry().GetByID(cmd.DeviceID) == nil {
+		d.finish(&Outcome{Command: cmd, Status: CommandOffline, Err: ErrDeviceOffline})
+		return
+	}
+
+	go func() {
+		d.finish(d.deliver(cmd, false))
+	}()
+}
+
+// Pending returns the commands waiting for an ack
+func (d *Dispatcher) Pending() []*Command {
+	d.pendingLock.Lock()
+	defer d.pendingLock.Unlock()
+
+	cmds := make([]*Command, 0, len(d.pending))
+	for cmd := range d.pending {
+		cmds = append(cmds, cmd)
+	}
+
+	return cmds
+}
+
+// enqueue queues cmd behind the commands of its device
+func (d *Dispatcher) enqueue(cmd *Command) error {
+	queued := &QueuedCommand{
+		ID:       cmd.ID,
+		DeviceID: cmd.DeviceID,
+		Topic:    cmd.Topic,
+		Payload:  cmd.Payload,
+	}
+	if d.config.QueueTTL > 0 {
+		queued.Expires = time.Now().Add(d.config.QueueTTL)
+	}
+
+	return d.config.Queue.Push(queued)
+}
+
+// startWorker makes sure a worker delivers the queue of deviceID
+func (d *Dispatcher) startWorker(deviceID string) {
+	d.workerLock.Lock()
+	defer d.workerLock.Unlock()
+
+	if _, ok := d.workers[deviceID]; ok {
+		d.workers[deviceID] = true
+		return
+	}
+	d.workers[deviceID] = false
+
+	go d.work(deviceID)
+}
+
+// busy tells whether a worker is delivering the queue of deviceID
+func (d *Dispatcher) busy(deviceID string) bool {
+	d.workerLock.Lock()
+	defer d.workerLock.Unlock()
+
+	_, ok := d.workers[deviceID]
+	return ok
+}
+
+// work delivers the queue of deviceID one command after another, a command
+// is only removed from the queue once it has an outcome. It stops when the
+// queue is empty or the device goes offline, leaving its commands queued.
+func (d *Dispatcher) work(deviceID string) {
+	for {
+		for d.deliverQueued(deviceID) {
+		}
+
+		// a command may have been queued or the device bound meanwhile
+		d.workerLock.Lock()
+		if !d.workers[deviceID] {
+			delete(d.workers, deviceID)
+			d.workerLock.Unlock()
+			return
+		}
+		d.workers[deviceID] = false
+		d.workerLock.Unlock()
+	}
+}
+
+// deliverQueued delivers the first command queued for deviceID, false if
+// there is none or the device is offline
+func (d *Dispatcher) deliverQueued(deviceID string) bool {
+	q, err := d.config.Queue.Peek(deviceID)
+	if err != nil {
+		log.Println("peek offline queue of", deviceID, err)
+	}
+	if q == nil {
+		return false
+	}
+
+	if q.expired(time.Now()) {
+		d.remove(q)
+		d.expire(q)
+		return true
+	}
+
+	cmd, err := d.config.Decode(q.Payload)
+	if err != nil {
+		log.Println("decode queued command", q.ID, err)
+		d.remove(q)
+		return true
+	}
+
+	outcome := d.deliver(cmd, true)
+	if outcome.Status == CommandOffline {
+		// delivered again once the device logs in
+		return false
+	}
+
+	d.remove(q)
+	d.finish(outcome)
+	return true
+}
+
+func (d *Dispatcher) remove(q *QueuedCommand) {
+	if err := d.config.Queue.Remove(q); err != nil {
+		log.Println("remove queued command", q.ID, err)
+	}
+}
+
+func (d *Dispatcher) expireLoop() {
+	tick := time.Second
+	if d.config.QueueTTL < tick {
+		tick = d.config.QueueTTL
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.exitChan:
+			return
+
+		case now := <-ticker.C:
+			// the workers expire the commands of their device themselves
+			expired, err := d.config.Queue.Expire(now, d.busy)
+			if err != nil {
+				log.Println("expire offline queue", err)
+			}
+			for _, q := range expired {
+				d.expire(q)
+			}
+		}
+	}
+}
+
+// expire reports q with CommandExpired
+func (d *Dispatcher) expire(q *QueuedCommand) {
+	cmd, err := d.config.Decode(q.Payload)
+	if err != nil {
+		cmd = &Command{ID: q.ID, DeviceID: q.DeviceID, Topic: q.Topic, Payload: q.Payload}
+	}
+
+	d.finish(&Outcome{Command: cmd, Status: CommandExpired, Err: ErrCommandExpired})
+}
+
+// deliver sends cmd until it is acked or the retries run out. If queued,
+// it gives up as soon as the device is offline so cmd stays queued.
+func (d *Dispatcher) deliver(cmd *Command, queued bool) *Outcome {
+	d.pendingLock.Lock()
+	d.pending[cmd] = struct{}{}
+	d.pendingLock.Unlock()
+
+	defer func() {
+		d.pendingLock.Lock()
+		delete(d.pending, cmd)
+		d.pendingLock.Unlock()
+	}()
+
+	timeout := d.config.Timeout
+	if timeout <= 0 {
+		timeout = defaultCommandTimeout
+	}
+
+	outcome := &Outcome{Command: cmd}
+	for outcome.Attempts <= d.config.Retries {
+		outcome.Attempts++
+
+		// the device may have reconnected since the last attempt
+		c := d.mqhub.Registry().GetByID(cmd.DeviceID)
+		if c == nil {
+			outcome.Err = ErrDeviceOffline
+			if queued {
+				break
+			}
+			time.Sleep(timeout)
+			continue
+		}
+
+		outcome.Conn = c
+		var resp Packet
+		f, err := c.RequestAsync(cmd.Packet, timeout)
+		if err == nil {
+			resp, err = f.Wait()
+		}
+		if err != nil {
+			outcome.Err = err
+			if err == ErrConnClosing && queued {
+				break
+			}
+			if err != ErrRequestTimeout && err != ErrConnClosing && err != ErrWriteBlocking {
+				break
+			}
+			continue
+		}
+
+		outcome.Response, outcome.ReceivedAt, outcome.Err = resp, f.ReceivedAt(), nil
+		break
+	}
+	outcome.Status = commandStatus(outcome, d.config.Ack)
+
+	return outcome
+}
+
+// commandStatus tells the status of a delivered command from its last attempt
+func commandStatus(outcome *Outcome, ack func(resp Packet) bool) CommandStatus {
+	switch outcome.Err {
+	case nil:
+		if ack != nil && !ack(outcome.Response) {
+			return CommandFailure
+		}
+		return CommandSuccess
+
+	case ErrRequestTimeout:
+		return CommandTimeout
+
+	case ErrDeviceOffline, ErrConnClosing:
+		return CommandOffline
+	}
+
+	// the command could not be sent, such as ErrWriteBlocking or ErrNoCorrelationKey
+	return CommandFailure
+}
+
+// finish reports outcome, it is published through Mqhub.Publish so the
+// encoding of the topic decides whether consumers get the whole envelope
+func (d *Dispatcher) finish(outcome *Outcome) {
+	if d.config.OnOutcome != nil {
+		d.config.OnOutcome(outcome)
+	}
+
+	topic := outcome.Command.Topic
+	if topic == "" {
+		topic = d.config.Topic
+	}
+	if topic == "" {
+		return
+	}
+
+	encode := d.config.Encode
+	if encode == nil {
+		encode = encodeOutcome
+	}
+	if body := encode(outcome); body != nil {
+		if err := d.mqhub.Publish(topic, d.envelope(outcome, body)); err != nil {
+			log.Println("publish outcome of", outcome.Command.ID, err)
+		}
+	}
+}
+
+// envelope wraps the encoded outcome, it is published as the ack of the
+// device, received from the conn of the last attempt
+func (d *Dispatcher) envelope(outcome *Outcome, body []byte) *envelope.Envelope {
+	e := &envelope.Envelope{
+		DeviceID: outcome.Command.DeviceID,
+		Time:     outcome.ReceivedAt,
+		Type:     d.config.EventType,
+		Payload:  body,
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if e.Type == "" {
+		e.Type = defaultOutcomeType
+	}
+	if c := outcome.Conn; c != nil {
+		e.ConnID = c.GetIndex()
+		if addr := c.NetConn().RemoteAddr(); addr != nil {
+			e.RemoteAddr = addr.String()
+		}
+	}
+
+	return e
+}
+
+// encodeOutcome is the default outcome encoding
+func encodeOutcome(outcome *Outcome) []byte {
+	body := struct {
+		ID       string `json:"id"`
+		DeviceID string `json:"device_id"`
+		Status   string `json:"status"`
+		Attempts int    `json:"attempts"`
+		Error    string `json:"error,omitempty"`
+	}{
+		ID:       outcome.Command.ID,
+		DeviceID: outcome.Command.DeviceID,
+		Status:   outcome.Status.String(),
+		Attempts: outcome.Attempts,
+	}
+	if outcome.Err != nil {
+		body.Error = outcome.Err.Error()
+	}
+
+	b, _ := json.Marshal(body)
+	return b
+}
@@ -0,0 +1,132 @@
+package gotcp
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/giskook/gotcp/envelope"
+)
+
+func lineCommand(payload []byte) (*Command, error) {
+	id := string(payload)
+	return &Command{
+		ID:       id,
+		DeviceID: "BED",
+		Packet:   &linePacket{kind: "CMD", arg: id},
+		Payload:  payload,
+	}, nil
+}
+
+func TestDispatcherQueuedInOrder(t *testing.T) {
+	q := NewmqhubWithBroker(&MqConfig{}, nil, NewMemoryBroker())
+	q.Start()
+	defer q.Stop()
+	_, l := startLineServer(t, &Config{}, q)
+
+	outcomes := make(chan *Outcome, 16)
+	d := NewDispatcher(&DispatcherConfig{
+		Timeout:   time.Second,
+		Queue:     NewMemoryQueue(0),
+		QueueTTL:  time.Minute,
+		Decode:    lineCommand,
+		OnOutcome: func(o *Outcome) { outcomes <- o },
+	}, q)
+	defer d.Stop()
+
+	dispatch := func(from, to int) {
+		for i := from; i <= to; i++ {
+			cmd, _ := lineCommand([]byte(strconv.Itoa(i)))
+			d.Dispatch(cmd)
+		}
+	}
+
+	// queued while offline, the ones dispatched after the login must not overtake them
+	dispatch(1, 3)
+	cmds := make(chan string, 16)
+	conn := lineDevice(l, "BED", cmds)
+	defer conn.Close()
+	dispatch(4, 6)
+
+	for i := 1; i <= 6; i++ {
+		select {
+		case got := <-cmds:
+			if got != strconv.Itoa(i) {
+				t.Fatalf("command %s delivered as number %d", got, i)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("command %d not delivered", i)
+		}
+	}
+
+	for i := 1; i <= 6; i++ {
+		select {
+		case o := <-outcomes:
+			if o.Status != CommandSuccess {
+				t.Fatalf("command %s: %s %v", o.Command.ID, o.Status, o.Err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("outcome %d missing", i)
+		}
+	}
+}
+
+func TestDispatcherOfflineStatus(t *testing.T) {
+	q := NewmqhubWithBroker(&MqConfig{}, nil, NewMemoryBroker())
+	q.Start()
+	defer q.Stop()
+
+	outcomes := make(chan *Outcome, 1)
+	d := NewDispatcher(&DispatcherConfig{
+		Timeout:   10 * time.Millisecond,
+		Retries:   1,
+		OnOutcome: func(o *Outcome) { outcomes <- o },
+	}, q)
+
+	cmd, _ := lineCommand([]byte("1"))
+	d.Dispatch(cmd)
+	if o := <-outcomes; o.Status != CommandOffline || o.Err != ErrDeviceOffline {
+		t.Fatalf("got %s %v", o.Status, o.Err)
+	}
+}
+
+func TestDispatcherOutcomeEnvelope(t *testing.T) {
+	broker := NewMemoryBroker()
+	q := NewmqhubWithBroker(&MqConfig{Envelope: &envelope.Codec{Default: envelope.JSON}}, nil, broker)
+	q.Start()
+	defer q.Stop()
+	_, l := startLineServer(t, &Config{}, q)
+
+	outcomes := consume(t, broker, "outcome")
+	d := NewDispatcher(&DispatcherConfig{Topic: "outcome", EventType: "feedback"}, q)
+	defer d.Stop()
+
+	conn := lineDevice(l, "BED", make(chan string, 1))
+	defer conn.Close()
+	waitBound(t, q, "BED", nil)
+	bed := q.GetConn("BED")
+
+	sent := time.Now()
+	cmd, _ := lineCommand([]byte("1"))
+	d.Dispatch(cmd)
+
+	e, err := envelope.Unmarshal([]byte(receive(t, outcomes, "outcome")), envelope.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != "feedback" || e.DeviceID != "BED" || e.ConnID != bed.GetIndex() || e.RemoteAddr != "pipe" {
+		t.Fatalf("envelope %+v", e)
+	}
+	if e.Time.Before(sent) || e.Time.After(time.Now()) {
+		t.Fatalf("ack received at %v, the command was sent at %v", e.Time, sent)
+	}
+
+	var outcome struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(e.Payload, &outcome); err != nil || outcome.ID != "1" || outcome.Status != "success" {
+		t.Fatalf("payload %s: %v", e.Payload, err)
+	}
+}
@@ -0,0 +1,84 @@
+package gotcp
+
+import (
+	"log"
+	"time"
+)
+
+// defaultDownstreamTimeout is how long a downstream packet waits for
+// room in a full write queue before the message is redelivered
+const defaultDownstreamTimeout = time.Second
+
+// Downstream is a broker message decoded for delivery to a device
+type Downstream struct {
+	DeviceID string // the device ID the target conn is bound to
+	Packet   Packet
+	ReplyTo  string // the topic Offline is published to, no report if ""
+	Offline  []byte // reports the device offline to the sender of the message
+	Body     []byte // the broker message, set by Mqhub
+}
+
+// DownstreamDecoder decodes a message consumed by Mqhub.Subscribe,
+// messages it fails to decode are dropped
+type DownstreamDecoder func(body []byte) (*Downstream, error)
+
+// DownstreamHandler delivers d to c, the conn d.DeviceID is bound to, c is
+// nil if the device is offline. The message is redelivered on error.
+type DownstreamHandler func(d *Downstream, c *Conn) error
+
+// Subscribe consumes the messages of topic on channel, decodes them with
+// decoder and routes them to the conns their device ID is bound to, see
+// OnDownstream
+func (q *Mqhub) Subscribe(topic, channel string, decoder DownstreamDecoder) error {
+	if q.broker == nil {
+		return ErrNoBroker
+	}
+
+	return q.broker.Subscribe(topic, channel, func(body []byte) error {
+		d, err := decoder(body)
+		if err != nil {
+			log.Printf("drop message of topic %s: %v", topic, err)
+			return nil
+		}
+		d.Body = body
+
+		return q.route(d)
+	})
+}
+
+// OnDownstream replaces how Subscribe delivers the decoded messages, by
+// default the packet is written with PriorityBroker and Offline is
+// published to ReplyTo if the device is offline
+func (q *Mqhub) OnDownstream(h DownstreamHandler) {
+	q.downstream = h
+}
+
+func (q *Mqhub) route(d *Downstream) error {
+	c := q.registry.GetByID(d.DeviceID)
+	if q.downstream != nil {
+		return q.downstream(d, c)
+	}
+
+	if c != nil {
+		timeout := q.config.WriteTimeout
+		if timeout <= 0 {
+			timeout = defaultDownstreamTimeout
+		}
+
+		err := c.NsqWritePacket(d.Packet, timeout)
+		if err != ErrConnClosing {
+			return err
+		}
+	}
+
+	return q.ReportOffline(d)
+}
+
+// ReportOffline publishes d.Offline to d.ReplyTo
+func (q *Mqhub) ReportOffline(d *Downstream) error {
+	if d.ReplyTo == "" || d.Offline == nil {
+		return nil
+	}
+
+	return q.Send(d.ReplyTo, d.Offline)
+}
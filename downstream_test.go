@@ -0,0 +1,123 @@
+package gotcp
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// decodeLine decodes "device arg" messages into CMD packets
+func decodeLine(body []byte) (*Downstream, error) {
+	id, arg := splitLine(string(body))
+	return &Downstream{
+		DeviceID: id,
+		Packet:   &linePacket{kind: "CMD", arg: arg},
+		ReplyTo:  "offline",
+		Offline:  []byte(arg),
+	}, nil
+}
+
+// consume returns the bodies published to topic
+func consume(t *testing.T, broker Broker, topic string) <-chan string {
+	bodies := make(chan string, 16)
+	if err := broker.Subscribe(topic, "test", func(body []byte) error {
+		bodies <- string(body)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	return bodies
+}
+
+func receive(t *testing.T, c <-chan string, what string) string {
+	t.Helper()
+	select {
+	case s := <-c:
+		return s
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no %s", what)
+	}
+	return ""
+}
+
+func TestSubscribeRoute(t *testing.T) {
+	broker := NewMemoryBroker()
+	q := NewmqhubWithBroker(&MqConfig{}, nil, broker)
+	q.Start()
+	defer q.Stop()
+	_, l := startLineServer(t, &Config{}, q)
+
+	offline := consume(t, broker, "offline")
+	if err := q.Subscribe("down", "gotcp", decodeLine); err != nil {
+		t.Fatal(err)
+	}
+
+	cmds := make(chan string, 16)
+	conn := lineDevice(l, "BED", cmds)
+	defer conn.Close()
+	waitBound(t, q, "BED", nil)
+
+	broker.Publish("down", []byte("BED 1"))
+	broker.Publish("down", []byte("GONE 2"))
+	if got := receive(t, cmds, "packet"); got != "1" {
+		t.Fatalf("device got %q", got)
+	}
+	if got := receive(t, offline, "offline report"); got != "2" {
+		t.Fatalf("offline report %q", got)
+	}
+}
+
+// TestSubscribeDispatch follows a command from the broker to the device
+// and its ack back to the outcome published to the broker
+func TestSubscribeDispatch(t *testing.T) {
+	broker := NewMemoryBroker()
+	q := NewmqhubWithBroker(&MqConfig{}, nil, broker)
+	q.Start()
+	defer q.Stop()
+	_, l := startLineServer(t, &Config{}, q)
+
+	outcomes := consume(t, broker, "outcome")
+	d := NewDispatcher(&DispatcherConfig{Timeout: time.Second, Topic: "outcome"}, q)
+	defer d.Stop()
+
+	q.OnDownstream(func(down *Downstream, c *Conn) error {
+		_, arg := splitLine(string(down.Body))
+		d.Dispatch(&Command{ID: arg, DeviceID: down.DeviceID, Packet: down.Packet, Payload: down.Body})
+		return nil
+	})
+	if err := q.Subscribe("down", "gotcp", decodeLine); err != nil {
+		t.Fatal(err)
+	}
+
+	cmds := make(chan string, 16)
+	conn := lineDevice(l, "BED", cmds)
+	defer conn.Close()
+	waitBound(t, q, "BED", nil)
+
+	broker.Publish("down", []byte("BED 7"))
+	if got := receive(t, cmds, "command"); got != "7" {
+		t.Fatalf("device got %q", got)
+	}
+
+	var outcome struct {
+		ID       string `json:"id"`
+		DeviceID string `json:"device_id"`
+		Status   string `json:"status"`
+		Attempts int    `json:"attempts"`
+	}
+	if err := json.Unmarshal([]byte(receive(t, outcomes, "outcome")), &outcome); err != nil {
+		t.Fatal(err)
+	}
+	if outcome.ID != "7" || outcome.DeviceID != "BED" || outcome.Status != "success" || outcome.Attempts != 1 {
+		t.Fatalf("outcome %+v", outcome)
+	}
+
+	broker.Publish("down", []byte("GONE 8"))
+	if err := json.Unmarshal([]byte(receive(t, outcomes, "outcome")), &outcome); err != nil {
+		t.Fatal(err)
+	}
+	if outcome.ID != "8" || outcome.Status != "offline" {
+		t.Fatalf("outcome %+v", outcome)
+	}
+}
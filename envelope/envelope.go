@@ -0,0 +1,113 @@
+// Package envelope is the structured form of the events gateways publish
+// upstream. An Envelope wraps the payload of an event with where and when
+// it was received, and is encoded raw, as JSON or as protobuf. Producers
+// and consumers pick the encoding of a topic with the same Codec.
+package envelope
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrUnknownEncoding = errors.New("envelope: unknown encoding")
+
+// Envelope is an event received from a device
+type Envelope struct {
+	DeviceID   string    // the device ID bound to the connection, "" if none
+	ConnID     uint64    // the index of the connection
+	RemoteAddr string    // the remote address of the connection
+	Time       time.Time // when the event was received
+	Type       string    // the event type, such as "feedback"
+	Payload    []byte
+}
+
+// Encoding is how an Envelope is put on the wire
+type Encoding int
+
+const (
+	Raw      Encoding = iota // the payload only, for consumers of the bare device layouts
+	JSON                     // a JSON object, the payload base64 encoded
+	Protobuf                 // the protobuf message described in protobuf.go
+)
+
+func (e Encoding) String() string {
+	switch e {
+	case Raw:
+		return "raw"
+	case JSON:
+		return "json"
+	case Protobuf:
+		return "protobuf"
+	}
+
+	return "unknown"
+}
+
+// ParseEncoding returns the Encoding named s, as returned by String
+func ParseEncoding(s string) (Encoding, error) {
+	switch s {
+	case "raw":
+		return Raw, nil
+	case "json":
+		return JSON, nil
+	case "protobuf":
+		return Protobuf, nil
+	}
+
+	return Raw, fmt.Errorf("envelope: unknown encoding %q", s)
+}
+
+// Marshal encodes e with encoding
+func Marshal(e *Envelope, encoding Encoding) ([]byte, error) {
+	switch encoding {
+	case Raw:
+		return e.Payload, nil
+	case JSON:
+		return marshalJSON(e)
+	case Protobuf:
+		return marshalProtobuf(e), nil
+	}
+
+	return nil, ErrUnknownEncoding
+}
+
+// Unmarshal decodes an Envelope encoded with encoding, a Raw one only
+// has its Payload set
+func Unmarshal(data []byte, encoding Encoding) (*Envelope, error) {
+	switch encoding {
+	case Raw:
+		return &Envelope{Payload: data}, nil
+	case JSON:
+		return unmarshalJSON(data)
+	case Protobuf:
+		return unmarshalProtobuf(data)
+	}
+
+	return nil, ErrUnknownEncoding
+}
+
+// Codec picks the encoding of each topic
+type Codec struct {
+	Default Encoding            // the encoding of the topics not in Topics
+	Topics  map[string]Encoding // the encoding by topic
+}
+
+// Encoding returns the encoding of topic
+func (c *Codec) Encoding(topic string) Encoding {
+	if encoding, ok := c.Topics[topic]; ok {
+		return encoding
+	}
+
+	return c.Default
+}
+
+// Marshal encodes e to be published to topic
+func (c *Codec) Marshal(topic string, e *Envelope) ([]byte, error) {
+	return Marshal(e, c.Encoding(topic))
+}
+
+// Unmarshal decodes an Envelope consumed from topic
+func (c *Codec) Unmarshal(topic string, data []byte) (*Envelope, error) {
+	return Unmarshal(data, c.Encoding(topic))
+}
@@ -0,0 +1,153 @@
+package envelope
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func sample() *Envelope {
+	return &Envelope{
+		DeviceID:   "BED",
+		ConnID:     300,
+		RemoteAddr: "1.2.3.4:5",
+		Time:       time.Unix(0, 1),
+		Type:       "t",
+		Payload:    []byte{0xBA},
+	}
+}
+
+// wire is sample encoded by hand after the message in protobuf.go
+var wire = []byte{
+	0x0A, 0x03, 'B', 'E', 'D', // device_id = 1
+	0x10, 0xAC, 0x02, // conn_id = 2
+	0x1A, 0x09, '1', '.', '2', '.', '3', '.', '4', ':', '5', // remote_addr = 3
+	0x20, 0x01, // time = 4
+	0x2A, 0x01, 't', // type = 5
+	0x32, 0x01, 0xBA, // payload = 6
+}
+
+func expectEnvelope(t *testing.T, got, expected *Envelope) {
+	t.Helper()
+	if got.DeviceID != expected.DeviceID || got.ConnID != expected.ConnID || got.RemoteAddr != expected.RemoteAddr ||
+		!got.Time.Equal(expected.Time) || got.Type != expected.Type || !bytes.Equal(got.Payload, expected.Payload) {
+		t.Fatalf("decoded %+v, expected %+v", got, expected)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, encoding := range []Encoding{JSON, Protobuf} {
+		e := sample()
+		e.Time = time.Now()
+		data, err := Marshal(e, encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Unmarshal(data, encoding)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		expectEnvelope(t, got, e)
+
+		// the zero values are left out and come back as such
+		data, _ = Marshal(&Envelope{}, encoding)
+		if got, err = Unmarshal(data, encoding); err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		expectEnvelope(t, got, &Envelope{})
+	}
+
+	data, _ := Marshal(sample(), Raw)
+	got, _ := Unmarshal(data, Raw)
+	expectEnvelope(t, got, &Envelope{Payload: sample().Payload})
+
+	if _, err := Marshal(sample(), Encoding(9)); err != ErrUnknownEncoding {
+		t.Fatalf("unknown encoding: %v", err)
+	}
+}
+
+func TestProtobufWire(t *testing.T) {
+	data, _ := Marshal(sample(), Protobuf)
+	if !bytes.Equal(data, wire) {
+		t.Fatalf("encoded % X, expected % X", data, wire)
+	}
+
+	got, err := Unmarshal(wire, Protobuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEnvelope(t, got, sample())
+}
+
+func TestProtobufUnknownFields(t *testing.T) {
+	data := []byte{
+		0x38, 0x05, // 7 varint
+		0x41, 1, 2, 3, 4, 5, 6, 7, 8, // 8 fixed64
+		0x4A, 0x02, 'x', 'y', // 9 bytes
+		0x55, 1, 2, 3, 4, // 10 fixed32
+		0x08, 0x01, // device_id with the wrong wire type
+	}
+	data = append(data, wire...)
+	data = append(data, 0xF8, 0x07, 0x01) // 127 varint
+
+	got, err := Unmarshal(data, Protobuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEnvelope(t, got, sample())
+}
+
+func TestProtobufMalformed(t *testing.T) {
+	for _, data := range [][]byte{
+		{0x80},            // a truncated tag
+		{0x10, 0x80},      // a truncated varint
+		{0x41, 1, 2, 3},   // a short fixed64
+		{0x55, 1},         // a short fixed32
+		{0x0A, 0x05, 'a'}, // bytes longer than the message
+		{0x0A, 0x80},      // a truncated length
+		{0x0B},            // a group
+		{0x0E},            // wire type 6
+		{0x00, 0x01},      // field 0
+	} {
+		if _, err := Unmarshal(data, Protobuf); err != ErrProtobuf {
+			t.Errorf("% X: %v", data, err)
+		}
+	}
+
+	// every cut inside a field is malformed
+	boundaries := map[int]bool{0: true, 5: true, 8: true, 19: true, 21: true, 24: true, 27: true}
+	for i := range wire {
+		if _, err := Unmarshal(wire[:i], Protobuf); boundaries[i] != (err == nil) {
+			t.Errorf("cut at %d: %v", i, err)
+		}
+	}
+}
+
+func TestJSONMapping(t *testing.T) {
+	data, _ := Marshal(sample(), JSON)
+	expected := `{"device_id":"BED","conn_id":300,"remote_addr":"1.2.3.4:5","time":"` +
+		time.Unix(0, 1).Format(time.RFC3339Nano) + `","type":"t","payload":"ug=="}`
+	if string(data) != expected {
+		t.Fatalf("encoded %s, expected %s", data, expected)
+	}
+
+	if _, err := Unmarshal([]byte(`{"conn_id":"x"}`), JSON); err == nil {
+		t.Fatal("malformed JSON decoded")
+	}
+}
+
+func TestCodec(t *testing.T) {
+	c := &Codec{Default: JSON, Topics: map[string]Encoding{"bulk": Protobuf}}
+	if c.Encoding("bulk") != Protobuf || c.Encoding("other") != JSON {
+		t.Fatalf("bulk %s other %s", c.Encoding("bulk"), c.Encoding("other"))
+	}
+
+	for _, encoding := range []Encoding{Raw, JSON, Protobuf} {
+		if parsed, err := ParseEncoding(encoding.String()); err != nil || parsed != encoding {
+			t.Fatalf("%s parsed as %s: %v", encoding, parsed, err)
+		}
+	}
+	if _, err := ParseEncoding("xml"); err == nil {
+		t.Fatal("xml parsed")
+	}
+}
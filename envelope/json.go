@@ -0,0 +1,28 @@
+package envelope
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type jsonEnvelope struct {
+	DeviceID   string    `json:"device_id,omitempty"`
+	ConnID     uint64    `json:"conn_id"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	Payload    []byte    `json:"payload,omitempty"`
+}
+
+func marshalJSON(e *Envelope) ([]byte, error) {
+	return json.Marshal((*jsonEnvelope)(e))
+}
+
+func unmarshalJSON(data []byte) (*Envelope, error) {
+	e := &Envelope{}
+	if err := json.Unmarshal(data, (*jsonEnvelope)(e)); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
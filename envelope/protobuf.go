@@ -0,0 +1,137 @@
+package envelope
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// The Protobuf encoding is the message below, hand rolled to keep the
+// gateway free of a protobuf runtime
+//
+//	message Envelope {
+//	  string device_id   = 1;
+//	  uint64 conn_id     = 2;
+//	  string remote_addr = 3;
+//	  int64  time        = 4; // unix nano
+//	  string type        = 5;
+//	  bytes  payload     = 6;
+//	}
+const (
+	fieldDeviceID   = 1
+	fieldConnID     = 2
+	fieldRemoteAddr = 3
+	fieldTime       = 4
+	fieldType       = 5
+	fieldPayload    = 6
+
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var ErrProtobuf = errors.New("envelope: malformed protobuf")
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	return append(buf, b[:n]...)
+}
+
+func appendTag(buf []byte, field, wire int) []byte {
+	return appendUvarint(buf, uint64(field<<3|wire))
+}
+
+func appendVarint(buf []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return buf
+	}
+	buf = appendTag(buf, field, wireVarint)
+	return appendUvarint(buf, v)
+}
+
+func appendBytes(buf []byte, field int, b []byte) []byte {
+	if len(b) == 0 {
+		return buf
+	}
+	buf = appendTag(buf, field, wireBytes)
+	buf = appendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+func marshalProtobuf(e *Envelope) []byte {
+	buf := make([]byte, 0, 32+len(e.DeviceID)+len(e.RemoteAddr)+len(e.Type)+len(e.Payload))
+	buf = appendBytes(buf, fieldDeviceID, []byte(e.DeviceID))
+	buf = appendVarint(buf, fieldConnID, e.ConnID)
+	buf = appendBytes(buf, fieldRemoteAddr, []byte(e.RemoteAddr))
+	if !e.Time.IsZero() {
+		buf = appendVarint(buf, fieldTime, uint64(e.Time.UnixNano()))
+	}
+	buf = appendBytes(buf, fieldType, []byte(e.Type))
+	buf = appendBytes(buf, fieldPayload, e.Payload)
+
+	return buf
+}
+
+// unmarshalProtobuf decodes the message, skipping unknown fields
+func unmarshalProtobuf(data []byte) (*Envelope, error) {
+	e := &Envelope{}
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, ErrProtobuf
+		}
+		data = data[n:]
+
+		field, wire := int(tag>>3), int(tag&7)
+		if field == 0 {
+			return nil, ErrProtobuf
+		}
+		var v uint64
+		var b []byte
+		switch wire {
+		case wireVarint:
+			if v, n = binary.Uvarint(data); n <= 0 {
+				return nil, ErrProtobuf
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return nil, ErrProtobuf
+			}
+			data = data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return nil, ErrProtobuf
+			}
+			data = data[4:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return nil, ErrProtobuf
+			}
+			b = data[n : n+int(length)]
+			data = data[n+int(length):]
+		default:
+			return nil, ErrProtobuf
+		}
+
+		switch {
+		case field == fieldDeviceID && wire == wireBytes:
+			e.DeviceID = string(b)
+		case field == fieldConnID && wire == wireVarint:
+			e.ConnID = v
+		case field == fieldRemoteAddr && wire == wireBytes:
+			e.RemoteAddr = string(b)
+		case field == fieldTime && wire == wireVarint:
+			e.Time = time.Unix(0, int64(v))
+		case field == fieldType && wire == wireBytes:
+			e.Type = string(b)
+		case field == fieldPayload && wire == wireBytes:
+			e.Payload = append([]byte(nil), b...)
+		}
+	}
+
+	return e, nil
+}
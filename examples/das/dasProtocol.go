@@ -2,10 +2,12 @@ package das
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/giskook/go-toolkit"
 	"github.com/giskook/gotcp"
+	"github.com/giskook/gotcp/codec"
 )
 
 var (
@@ -22,27 +24,36 @@ type DasPacket struct {
 }
 
 func (p *DasPacket) Serialize() []byte {
-	// 0xBA command feedback 0xBB heartbeat 0xBC login
-	daspacket := p
-	command := daspacket.GetData()
-	commandtype := daspacket.GetType()
-	var feedback []byte
-	switch commandtype {
-	case 0xBA:
-		fmt.Printf("recv should up the result%x \n", command)
-	case 0xAB:
-		feedback = append(feedback, 0xAB)
-		feedback = append(feedback, command...)
-		feedback = append(feedback, endTag)
-	case 0xAC:
-		feedback = append(feedback, 0xAC)
-		feedback = append(feedback, command...)
+	feedback, _ := p.AppendTo(nil)
+
+	return feedback
+}
+
+func (p *DasPacket) AppendTo(feedback []byte) ([]byte, error) {
+	// 0xAB heartbeat ack 0xAC login ack
+	switch p.cmdtype {
+	case 0xAB, 0xAC:
+		feedback = append(feedback, p.cmdtype)
+		feedback = append(feedback, p.data...)
 		feedback = append(feedback, endTag)
 	default:
-		gktoolkit.Trace()
+		return feedback, fmt.Errorf("das packet 0x%X can not be sent to a bed", p.cmdtype)
 	}
 
-	return feedback
+	return feedback, nil
+}
+
+func (p *DasPacket) PacketKey() interface{} {
+	return p.cmdtype
+}
+
+// CorrelationKey ties a 0xBA feedback to the command with the same serialid
+func (p *DasPacket) CorrelationKey() (interface{}, bool) {
+	if p.cmdtype != 0xBA || len(p.data) < 7 {
+		return nil, false
+	}
+
+	return gktoolkit.BytesToUInt32(p.data[3:7]), true
 }
 
 func (p *DasPacket) GetType() byte {
@@ -60,61 +71,72 @@ func NewDasPacket(cmdtype byte, data []byte) *DasPacket {
 	}
 }
 
+// DasProtocol frames "cmdtype + body + end tag" packets sent by the beds
 type DasProtocol struct {
+	codec.Tagged
 }
 
-func (this *DasProtocol) ReadPacket(goconn *gotcp.Conn) (gotcp.Packet, error) {
-	conn := goconn.GetRawConn()
-	for {
-		data := make([]byte, 1024)
-		readLengh, err := conn.Read(data)
-
-		if err != nil { // EOF, or worse
-			return nil, err
-		}
+func NewDasProtocol() *DasProtocol {
+	return &DasProtocol{
+		codec.Tagged{
+			Start:  []byte{0xBA, 0xBB, 0xBC},
+			End:    []byte{endTag},
+			Length: frameLength,
+			Decode: decodeDasFrame,
+		},
+	}
+}
 
-		if readLengh == 0 { // Connection maybe cloased by the client
-			return nil, gotcp.ErrConnClosing
-		} else {
-			goconn.GetRecvBytes().Write(data[:readLengh])
-			fmt.Println(goconn.GetRecvBytes().Bytes())
-			if goconn.GetRecvBytes().Bytes()[0] == 0xBA ||
-				goconn.GetRecvBytes().Bytes()[0] == 0xBB ||
-				goconn.GetRecvBytes().Bytes()[0] == 0xBC {
-				if goconn.GetRecvBytes().Len() >= 8 {
-					cmdtype, _ := goconn.GetRecvBytes().ReadByte()
-					if cmdtype == 0xBA {
-						result := goconn.GetRecvBytes().Next(6) // cmdtype + result + serialid
-						goconn.GetRecvBytes().Next(1)
-						return NewDasPacket(0xBA, result), nil
-					} else if cmdtype == 0xBB {
-						mac := goconn.GetRecvBytes().Next(6)
-						goconn.GetRecvBytes().Next(1)
-						return NewDasPacket(0xBB, mac), nil
-					} else if cmdtype == 0xBC {
-						mac := goconn.GetRecvBytes().Next(6)
-						goconn.GetRecvBytes().Next(1)
-						return NewDasPacket(0xBC, mac), nil
-					}
-				} else {
-					return nil, gotcp.ErrReadHalf
-				}
-			} else {
-				goconn.GetRecvBytes().Reset()
-				return nil, gotcp.ErrReadHalf
-			}
-		}
+// frameLength returns the length of a das frame starting with cmdtype
+func frameLength(cmdtype byte) int {
+	switch cmdtype {
+	case 0xBA: // cmdtype + command + direction + status + serialid(4) + end tag
+		return 9
+	case 0xBB, 0xBC: // cmdtype + mac(6) + end tag
+		return 8
 	}
+
+	return 0
+}
+
+func decodeDasFrame(frame []byte) (gotcp.Packet, error) {
+	return NewDasPacket(frame[0], frame[1:len(frame)-1]), nil
 }
 
+// DasCallback routes the packets of the beds by their cmdtype
 type DasCallback struct {
+	*gotcp.Router
+}
+
+func NewDasCallback() *DasCallback {
+	this := &DasCallback{gotcp.NewRouter()}
+	// 0xBA command feedback 0xBB heartbeat 0xBC login
+	this.Handle(byte(0xBA), this.onFeedback)
+	this.Handle(byte(0xBB), this.onHeartbeat)
+	this.Handle(byte(0xBC), this.onLogin)
+	this.Fallback(func(c *gotcp.Conn, p gotcp.Packet) bool {
+		gktoolkit.Trace()
+		return true
+	})
+
+	return this
 }
 
 func (this *DasCallback) OnConnect(c *gotcp.Conn) bool {
-	addr := c.GetRawConn().RemoteAddr()
+	addr := c.NetConn().RemoteAddr()
 	c.PutExtraData(addr)
 	fmt.Println("OnConnect:", addr)
 
+	// over mutual TLS the bed is identified by its certificate, not by the login packet
+	if id := c.PeerIdentity(); id != "" {
+		mac := strings.ToUpper(id)
+		if err := c.SetID(mac, c.GetIndex()); err != nil {
+			fmt.Println("login rejected:", mac, err)
+			return false
+		}
+		c.SetMac(mac)
+	}
+
 	return true
 }
 
@@ -128,38 +150,45 @@ func getMac(Mac []byte) string {
 	return mac
 }
 
-func (this *DasCallback) OnMessage(c *gotcp.Conn, p gotcp.Packet) bool {
-	// 0xBA command feedback 0xBB heartbeat 0xBC login
-	// 0xBA cmdtype(1-8) status(0/1) serialid
-	daspacket := p.(*DasPacket)
-	command := daspacket.GetData()
-	commandtype := daspacket.GetType()
-	fmt.Println("----onmessage ", command)
-	switch commandtype {
-	case 0xBA:
-		var result []byte
-		var cmdop byte
-		cmdop = command[0]*10 + command[1]
-		result = append(result, cmdop)
-		result = append(result, c.GetMac()...)
-		result = append(result, command[3:7]...)
-		result = append(result, command[2])
-		c.Send(c.GetTopic(), result)
-
-		fmt.Printf("-----recv should up the result%x \n", result)
-	case 0xBB:
-		c.SetTimeFlag(time.Now().Unix())
-		c.AsyncWritePacket(NewDasPacket(0xAB, command), time.Second)
-	case 0xBC:
-		c.SetID(getMac(command), c.GetIndex())
-		c.AsyncWritePacket(NewDasPacket(0xAC, command), time.Second)
-	default:
-		gktoolkit.Trace()
-	}
+// 0xBA cmdtype(1-8) status(0/1) serialid, feedbacks of dispatched
+// commands are consumed by the dispatcher and published with their
+// outcome, only the ones arriving after their command timed out end up here
+func (this *DasCallback) onFeedback(c *gotcp.Conn, p gotcp.Packet) bool {
+	fmt.Printf("-----drop late feedback of %s: %x\n", c.GetMac(), p.(*DasPacket).GetData())
+	return true
+}
 
+func (this *DasCallback) onHeartbeat(c *gotcp.Conn, p gotcp.Packet) bool {
+	c.SetTimeFlag(time.Now().Unix())
+	c.AsyncWritePacket(NewDasPacket(0xAB, p.(*DasPacket).GetData()), time.Second)
 	return true
 }
 
-func (this *DasCallback) OnClose(c *gotcp.Conn) {
-	fmt.Println("OnClose:", c.GetExtraData())
+func (this *DasCallback) onLogin(c *gotcp.Conn, p gotcp.Packet) bool {
+	command := p.(*DasPacket).GetData()
+	mac := getMac(command)
+	if id := c.PeerIdentity(); id != "" {
+		if !strings.EqualFold(id, mac) {
+			fmt.Println("login mac mismatch certificate:", mac, id)
+			return false
+		}
+	} else if err := c.SetID(mac, c.GetIndex()); err != nil {
+		fmt.Println("login rejected:", mac, err)
+		return false
+	}
+	c.SetMac(mac)
+	c.AsyncWritePacket(NewDasPacket(0xAC, command), time.Second)
+	return true
+}
+
+func (this *DasCallback) OnDuplicateLogin(d *gotcp.DuplicateLogin) {
+	fmt.Printf("duplicate login %s: old %v new %v, %s\n", d.ID, d.Old.GetExtraData(), d.New.GetExtraData(), d.Policy)
+}
+
+func (this *DasCallback) OnError(c *gotcp.Conn, err error) {
+	fmt.Println("OnError:", c.GetExtraData(), err)
+}
+
+func (this *DasCallback) OnCloseReason(c *gotcp.Conn, reason gotcp.CloseReason) {
+	fmt.Println("OnClose:", c.GetExtraData(), reason)
 }
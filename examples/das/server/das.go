@@ -1,19 +1,21 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
-	"github.com/bitly/go-nsq"
 	"github.com/giskook/go-toolkit"
 	"github.com/giskook/gotcp"
+	"github.com/giskook/gotcp/envelope"
 	"github.com/giskook/gotcp/examples/das"
 )
 
@@ -31,51 +33,73 @@ func getMacByte(Mac string) []byte {
 	return mac
 }
 
-func recvNsq(q *gotcp.Mqhub, topic string, channel string) {
-	config := nsq.NewConfig()
-	consumer, errormsg := nsq.NewConsumer(topic, channel, config)
-	if errormsg != nil {
-		log.Printf("create Consumer error-->" + errormsg.Error())
-		return
+// decodeDownstream decodes the nsq message "cmdtype + mac(12) + serialid(4) + topic",
+// cmdtype 0 checks whether the bed is online
+func decodeDownstream(body []byte) (*gotcp.Downstream, error) {
+	if len(body) < 17 {
+		return nil, fmt.Errorf("command too short: %d bytes", len(body))
 	}
 
-	consumer.AddHandler(nsq.HandlerFunc(func(message *nsq.Message) error {
-		cmd := message.Body
-		fmt.Printf("recv message from nsq %v\n", cmd)
-		commandtype := cmd[0]
-		mac := string(cmd[1:13])
-		fmt.Printf("recv mac from nsq %s\n", mac)
-		serialid := gktoolkit.BytesToUInt32(cmd[13:17])
-		fmt.Printf("recv serialid from nsq %d\n", serialid)
-		_topic := string(cmd[17:len(cmd)])
-		fmt.Printf("recv topic from nsq %s\n", _topic)
-		var feedback []byte
-		if commandtype == 0 { // check online
-			feedback = append(feedback, 0x00)
-			feedback = append(feedback, mac...)
-			feedback = append(feedback, gktoolkit.UInt32ToBytes(serialid)...)
-			if q.Exist(mac) {
-				feedback = append(feedback, 0x01)
-			} else {
-				feedback = append(feedback, 0x00)
-			}
-			q.Send(_topic, feedback)
-		} else {
-			macupper := strings.ToUpper(mac)
-			if q.GetConn(macupper) != nil {
-				fmt.Printf("-------mac :%s,topic :%s----\n", mac, _topic)
-				q.GetConn(macupper).SetTopic(_topic)
-				q.GetConn(macupper).SetMac(macupper)
-				q.GetConn(macupper).NsqWritePacket(das.NewNsqPacket(_topic, commandtype, getMacByte(macupper), serialid, 0), time.Second)
+	commandtype := body[0]
+	macupper := strings.ToUpper(string(body[1:13]))
+	serialid := gktoolkit.BytesToUInt32(body[13:17])
+	topic := string(body[17:])
+	fmt.Printf("recv command %d for %s serialid %d topic %s\n", commandtype, macupper, serialid, topic)
+
+	return &gotcp.Downstream{
+		DeviceID: macupper,
+		Packet:   das.NewNsqPacket(topic, commandtype, getMacByte(macupper), serialid, 0),
+		ReplyTo:  topic,
+		Offline:  onlineFeedback(macupper, serialid, 0x00),
+		Body:     body,
+	}, nil
+}
+
+// decodeCommand decodes the nsq message of a command queued offline
+func decodeCommand(body []byte) (*gotcp.Command, error) {
+	d, err := decodeDownstream(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return newCommand(d), nil
+}
+
+func newCommand(d *gotcp.Downstream) *gotcp.Command {
+	return &gotcp.Command{
+		ID:       strconv.FormatUint(uint64(d.Packet.(*das.NsqPacket).GetSerialID()), 10),
+		DeviceID: d.DeviceID,
+		Packet:   d.Packet,
+		Topic:    d.ReplyTo,
+		Payload:  d.Body,
+	}
+}
+
+// onlineFeedback is the answer to a check online, 0x00 + mac + serialid + online
+func onlineFeedback(mac string, serialid uint32, online byte) []byte {
+	var feedback []byte
+	feedback = append(feedback, 0x00)
+	feedback = append(feedback, mac...)
+	feedback = append(feedback, gktoolkit.UInt32ToBytes(serialid)...)
+	feedback = append(feedback, online)
+
+	return feedback
+}
+
+// routeCommand answers the online checks and hands the commands to the
+// dispatcher, their outcome is published to the reply topic once the bed
+// acks, the retries run out or, if the bed is offline, the queued command expires
+func routeCommand(q *gotcp.Mqhub, dispatcher *gotcp.Dispatcher) gotcp.DownstreamHandler {
+	return func(d *gotcp.Downstream, c *gotcp.Conn) error {
+		if d.Packet.(*das.NsqPacket).GetType() == 0 { // check online
+			if c == nil {
+				return q.ReportOffline(d)
 			}
+			return q.Send(d.ReplyTo, onlineFeedback(d.DeviceID, d.Packet.(*das.NsqPacket).GetSerialID(), 0x01))
 		}
 
+		dispatcher.Dispatch(newCommand(d))
 		return nil
-	}))
-
-	err := consumer.ConnectToNSQD(q.GetAddr())
-	if err != nil {
-		log.Panic("Could not connect")
 	}
 }
 
@@ -91,32 +115,84 @@ func main() {
 	config := &gotcp.Config{
 		PacketSendChanLimit:    20,
 		PacketReceiveChanLimit: 20,
+		ReadIdleTimeout:        600 * time.Second,
+		PresenceTopic:          "presence", // the backend keeps its online map from there
+	}
+
+	// serve mutual TLS when a certificate is configured
+	if cert := os.Getenv("DAS_TLS_CERT"); cert != "" {
+		config.TLSConfig, err = gotcp.NewTLSConfig(cert, os.Getenv("DAS_TLS_KEY"), os.Getenv("DAS_TLS_CLIENT_CA"))
+		checkError(err)
+		config.HandshakeTimeout = 10 * time.Second
 	}
 
 	mqconfig := &gotcp.MqConfig{
 		Addr:    "127.0.0.1:4150",
 		Topic:   "commandproduce",
 		Channel: "1",
+		// the feedbacks wait on disk while nsqd is down
+		Spool: &gotcp.SpoolConfig{Dir: "spool"},
 	}
 
-	nsqhub := gotcp.Newmqhub(mqconfig, &das.NsqProtocol{})
+	// DAS_ENVELOPE=json or protobuf wraps the feedbacks in an envelope, raw by default
+	if name := os.Getenv("DAS_ENVELOPE"); name != "" {
+		encoding, err := envelope.ParseEncoding(name)
+		checkError(err)
+		mqconfig.Envelope = &envelope.Codec{Default: encoding}
+	}
+
+	// DAS_BROKER=memory runs the gateway without a nsqd
+	var broker gotcp.Broker
+	if os.Getenv("DAS_BROKER") == "memory" {
+		broker = gotcp.NewMemoryBroker()
+	}
+	nsqhub := gotcp.NewmqhubWithBroker(mqconfig, das.NewNsqProtocol(), broker)
 
 	nsqhub.Start()
-	go recvNsq(nsqhub, "command", "1")
+	// commands for offline beds wait on disk for their login
+	queue, err := gotcp.NewFileQueue("offline", 32)
+	checkError(err)
+	dispatcher := gotcp.NewDispatcher(&gotcp.DispatcherConfig{
+		Timeout:   5 * time.Second,
+		Retries:   2,
+		Encode:    das.EncodeOutcome,
+		EventType: "feedback",
+		Queue:     queue,
+		QueueTTL:  10 * time.Minute,
+		Decode:    decodeCommand,
+	}, nsqhub)
+	defer dispatcher.Stop()
+	nsqhub.OnDownstream(routeCommand(nsqhub, dispatcher))
+	if err := nsqhub.Subscribe("command", "1", decodeDownstream); err != nil {
+		log.Panic("Could not connect: ", err)
+	}
 
-	srv := gotcp.NewServer(config, &das.DasCallback{}, &das.DasProtocol{}, nsqhub)
+	srv := gotcp.NewServer(config, das.NewDasCallback(), das.NewDasProtocol(), nsqhub)
+	srv.Pipeline().
+		AddInbound("log", gotcp.InboundHandlerFunc(func(ctx *gotcp.HandlerContext, p gotcp.Packet) error {
+			fmt.Printf("recv %v: %v\n", ctx.Conn().GetExtraData(), p)
+			return ctx.FireRead(p)
+		})).
+		AddOutbound("log", gotcp.OutboundHandlerFunc(func(ctx *gotcp.HandlerContext, p gotcp.Packet) error {
+			fmt.Printf("send %v: %v\n", ctx.Conn().GetExtraData(), p)
+			return ctx.FireWrite(p)
+		}))
 
 	// starts service
 	go srv.Start(listener, time.Second)
 	fmt.Println("listening:", listener.Addr())
 
 	// catchs system signal
-	chSig := make(chan os.Signal)
+	chSig := make(chan os.Signal, 1)
 	signal.Notify(chSig, syscall.SIGINT, syscall.SIGTERM)
 	fmt.Println("Signal: ", <-chSig)
 
-	// stops server
-	srv.Stop()
+	// stops server, giving the beds a few seconds to receive queued commands
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("shutdown:", err)
+	}
 }
 
 func checkError(err error) {
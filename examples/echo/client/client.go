@@ -6,6 +6,7 @@ import (
 	"net"
 	"time"
 
+	"github.com/giskook/gotcp"
 	"github.com/giskook/gotcp/examples/echo"
 )
 
@@ -15,7 +16,8 @@ func main() {
 	conn, err := net.DialTCP("tcp", nil, tcpAddr)
 	checkError(err)
 
-	echoProtocol := &echo.EchoProtocol{}
+	echoProtocol := echo.NewEchoProtocol()
+	reader := gotcp.NewFrameReader(conn)
 
 	// ping <--> pong
 	for i := 0; i < 3; i++ {
@@ -23,7 +25,7 @@ func main() {
 		conn.Write(echo.NewEchoPacket([]byte("hello"), false).Serialize())
 
 		// read
-		p, err := echoProtocol.ReadPacket(conn)
+		p, err := echoProtocol.Read(reader)
 		if err == nil {
 			echoPacket := p.(*echo.EchoPacket)
 			fmt.Printf("Server reply:[%v] [%v]\n", echoPacket.GetLength(), string(echoPacket.GetBody()))
@@ -2,11 +2,9 @@ package echo
 
 import (
 	"encoding/binary"
-	"errors"
-	"io"
-	"net"
 
 	"github.com/giskook/gotcp"
+	"github.com/giskook/gotcp/codec"
 )
 
 type EchoPacket struct {
@@ -40,30 +38,19 @@ func NewEchoPacket(buff []byte, hasLengthField bool) *EchoPacket {
 	return p
 }
 
+// EchoProtocol frames packets with a 4 byte big endian length field
 type EchoProtocol struct {
+	codec.LengthField
 }
 
-func (this *EchoProtocol) ReadPacket(conn *net.TCPConn) (gotcp.Packet, error) {
-	var (
-		lengthBytes []byte = make([]byte, 4)
-		length      uint32
-	)
-
-	// read length
-	if _, err := io.ReadFull(conn, lengthBytes); err != nil {
-		return nil, err
-	}
-	if length = binary.BigEndian.Uint32(lengthBytes); length > 1024 {
-		return nil, errors.New("the size of packet is larger than the limit")
-	}
-
-	buff := make([]byte, 4+length)
-	copy(buff[0:4], lengthBytes)
-
-	// read body ( buff = lengthBytes + body )
-	if _, err := io.ReadFull(conn, buff[4:]); err != nil {
-		return nil, err
+func NewEchoProtocol() *EchoProtocol {
+	return &EchoProtocol{
+		codec.LengthField{
+			Size:      4,
+			MaxLength: 4 + 1024,
+			Decode: func(frame []byte) (gotcp.Packet, error) {
+				return NewEchoPacket(frame, true), nil
+			},
+		},
 	}
-
-	return NewEchoPacket(buff, true), nil
 }
@@ -17,7 +17,7 @@ import (
 type Callback struct{}
 
 func (this *Callback) OnConnect(c *gotcp.Conn) bool {
-	addr := c.GetRawConn().RemoteAddr()
+	addr := c.NetConn().RemoteAddr()
 	c.PutExtraData(addr)
 	fmt.Println("OnConnect:", addr)
 	return true
@@ -48,14 +48,14 @@ func main() {
 		PacketSendChanLimit:    20,
 		PacketReceiveChanLimit: 20,
 	}
-	srv := gotcp.NewServer(config, &Callback{}, &echo.EchoProtocol{})
+	srv := gotcp.NewServer(config, &Callback{}, echo.NewEchoProtocol(), nil)
 
 	// starts service
 	go srv.Start(listener, time.Second)
 	fmt.Println("listening:", listener.Addr())
 
 	// catchs system signal
-	chSig := make(chan os.Signal)
+	chSig := make(chan os.Signal, 1)
 	signal.Notify(chSig, syscall.SIGINT, syscall.SIGTERM)
 	fmt.Println("Signal: ", <-chSig)
 
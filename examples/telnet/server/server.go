@@ -28,14 +28,14 @@ func main() {
 		PacketSendChanLimit:    20,
 		PacketReceiveChanLimit: 20,
 	}
-	srv := gotcp.NewServer(config, &telnet.TelnetCallback{}, &telnet.TelnetProtocol{})
+	srv := gotcp.NewServer(config, telnet.NewTelnetCallback(), telnet.NewTelnetProtocol(), nil)
 
 	// starts service
 	go srv.Start(listener, time.Second)
 	fmt.Println("listening:", listener.Addr())
 
 	// catchs system signal
-	chSig := make(chan os.Signal)
+	chSig := make(chan os.Signal, 1)
 	signal.Notify(chSig, syscall.SIGINT, syscall.SIGTERM)
 	fmt.Println("Signal: ", <-chSig)
 
@@ -1,12 +1,11 @@
 package telnet
 
 import (
-	"bytes"
 	"fmt"
-	"net"
 	"strings"
 
 	"github.com/giskook/gotcp"
+	"github.com/giskook/gotcp/codec"
 )
 
 var (
@@ -25,6 +24,10 @@ func (p *TelnetPacket) Serialize() []byte {
 	return buf
 }
 
+func (p *TelnetPacket) PacketKey() interface{} {
+	return p.pType
+}
+
 func (p *TelnetPacket) GetType() string {
 	return p.pType
 }
@@ -40,76 +43,68 @@ func NewTelnetPacket(pType string, pData []byte) *TelnetPacket {
 	}
 }
 
+// TelnetProtocol frames commands ending with "\r\n"
 type TelnetProtocol struct {
+	codec.Delimiter
 }
 
-func (this *TelnetProtocol) ReadPacket(conn *net.TCPConn) (gotcp.Packet, error) {
-	fullBuf := bytes.NewBuffer([]byte{})
-	for {
-		data := make([]byte, 1024)
-
-		readLengh, err := conn.Read(data)
-
-		if err != nil { //EOF, or worse
-			return nil, err
-		}
+func NewTelnetProtocol() *TelnetProtocol {
+	return &TelnetProtocol{
+		codec.Delimiter{
+			Delimiter: endTag,
+			MaxLength: 1024,
+			Decode:    decodeCommand,
+		},
+	}
+}
 
-		if readLengh == 0 { // Connection maybe closed by the client
-			return nil, gotcp.ErrConnClosing
+func decodeCommand(command []byte) (gotcp.Packet, error) {
+	commandList := strings.Split(string(command), " ")
+	if len(commandList) > 1 {
+		return NewTelnetPacket(commandList[0], []byte(commandList[1])), nil
+	} else {
+		if commandList[0] == "quit" {
+			return NewTelnetPacket("quit", command), nil
 		} else {
-			fullBuf.Write(data[:readLengh])
-
-			index := bytes.Index(fullBuf.Bytes(), endTag)
-			if index > -1 {
-				command := fullBuf.Next(index)
-				fullBuf.Next(2)
-				//fmt.Println(string(command))
-
-				commandList := strings.Split(string(command), " ")
-				if len(commandList) > 1 {
-					return NewTelnetPacket(commandList[0], []byte(commandList[1])), nil
-				} else {
-					if commandList[0] == "quit" {
-						return NewTelnetPacket("quit", command), nil
-					} else {
-						return NewTelnetPacket("unknow", command), nil
-					}
-				}
-			}
+			return NewTelnetPacket("unknow", command), nil
 		}
 	}
 }
 
+// TelnetCallback routes the commands by their type
 type TelnetCallback struct {
+	*gotcp.Router
+}
+
+func NewTelnetCallback() *TelnetCallback {
+	this := &TelnetCallback{gotcp.NewRouter()}
+	this.Handle("echo", func(c *gotcp.Conn, p gotcp.Packet) bool {
+		c.AsyncWritePacket(NewTelnetPacket("echo", p.(*TelnetPacket).GetData()), 0)
+		return true
+	})
+	this.Handle("login", func(c *gotcp.Conn, p gotcp.Packet) bool {
+		c.AsyncWritePacket(NewTelnetPacket("login", []byte(string(p.(*TelnetPacket).GetData())+" has login")), 0)
+		return true
+	})
+	this.Handle("quit", func(c *gotcp.Conn, p gotcp.Packet) bool {
+		return false
+	})
+	this.Fallback(func(c *gotcp.Conn, p gotcp.Packet) bool {
+		c.AsyncWritePacket(NewTelnetPacket("unknow", []byte("unknow command")), 0)
+		return true
+	})
+
+	return this
 }
 
 func (this *TelnetCallback) OnConnect(c *gotcp.Conn) bool {
-	addr := c.GetRawConn().RemoteAddr()
+	addr := c.NetConn().RemoteAddr()
 	c.PutExtraData(addr)
 	fmt.Println("OnConnect:", addr)
 	c.AsyncWritePacket(NewTelnetPacket("unknow", []byte("Welcome to this Telnet Server")), 0)
 	return true
 }
 
-func (this *TelnetCallback) OnMessage(c *gotcp.Conn, p gotcp.Packet) bool {
-	packet := p.(*TelnetPacket)
-	command := packet.GetData()
-	commandType := packet.GetType()
-
-	switch commandType {
-	case "echo":
-		c.AsyncWritePacket(NewTelnetPacket("echo", command), 0)
-	case "login":
-		c.AsyncWritePacket(NewTelnetPacket("login", []byte(string(command)+" has login")), 0)
-	case "quit":
-		return false
-	default:
-		c.AsyncWritePacket(NewTelnetPacket("unknow", []byte("unknow command")), 0)
-	}
-
-	return true
-}
-
 func (this *TelnetCallback) OnClose(c *gotcp.Conn) {
 	fmt.Println("OnClose:", c.GetExtraData())
 }
@@ -0,0 +1,205 @@
+package gotcp
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const queueFileExt = ".queue"
+
+// FileQueue is an OfflineQueue surviving restarts, the commands of a
+// device are appended as JSON lines to a file of dir named after its ID
+type FileQueue struct {
+	dir string
+
+	lock sync.Mutex // serializes the file updates
+	mem  *MemoryQueue
+}
+
+// NewFileQueue opens the queue stored in dir, loading the commands left
+// by a previous run. It holds at most maxDepth commands per device,
+// unlimited if maxDepth <= 0.
+func NewFileQueue(dir string, maxDepth int) (*FileQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	q := &FileQueue{
+		dir: dir,
+		mem: NewMemoryQueue(maxDepth),
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+func (q *FileQueue) path(deviceID string) string {
+	return filepath.Join(q.dir, hex.EncodeToString([]byte(deviceID))+queueFileExt)
+}
+
+func (q *FileQueue) load() error {
+	names, err := filepath.Glob(filepath.Join(q.dir, "*"+queueFileExt))
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		id, err := hex.DecodeString(strings.TrimSuffix(filepath.Base(name), queueFileExt))
+		if err != nil {
+			continue
+		}
+
+		cmds, err := readQueueFile(name)
+		if err != nil {
+			return err
+		}
+		// the depth was enforced when they were pushed
+		q.mem.queues[string(id)] = cmds
+
+		// drop a torn record, the next ones are appended after it
+		if err := q.rewrite(string(id), cmds); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readQueueFile reads the commands of a queue file, skipping the
+// record torn by a crash while it was appended
+func readQueueFile(name string) ([]*QueuedCommand, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cmds []*QueuedCommand
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		cmd := &QueuedCommand{}
+		if json.Unmarshal(scanner.Bytes(), cmd) == nil {
+			cmds = append(cmds, cmd)
+		}
+	}
+
+	return cmds, scanner.Err()
+}
+
+func (q *FileQueue) Push(cmd *QueuedCommand) error {
+	record, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if err := q.mem.Push(cmd); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(q.path(cmd.DeviceID), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err == nil {
+		_, err = f.Write(append(record, '\n'))
+		if err == nil {
+			err = f.Sync()
+		}
+		f.Close()
+	}
+	if err != nil {
+		// keep the file and the memory in step
+		q.rewrite(cmd.DeviceID, q.mem.pop(cmd.DeviceID))
+		return err
+	}
+
+	return nil
+}
+
+func (q *FileQueue) Peek(deviceID string) (*QueuedCommand, error) {
+	return q.mem.Peek(deviceID)
+}
+
+// Remove removes cmd and rewrites the file of its device, a command
+// stays on disk until it has an outcome
+func (q *FileQueue) Remove(cmd *QueuedCommand) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.mem.Remove(cmd)
+	return q.rewrite(cmd.DeviceID, q.mem.queue(cmd.DeviceID))
+}
+
+func (q *FileQueue) Expire(now time.Time, skip func(deviceID string) bool) ([]*QueuedCommand, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	expired, _ := q.mem.Expire(now, skip)
+
+	var err error
+	done := make(map[string]bool)
+	for _, cmd := range expired {
+		if done[cmd.DeviceID] {
+			continue
+		}
+		done[cmd.DeviceID] = true
+
+		if e := q.rewrite(cmd.DeviceID, q.mem.queue(cmd.DeviceID)); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return expired, err
+}
+
+// rewrite replaces the file of deviceID with cmds, removing it if empty
+func (q *FileQueue) rewrite(deviceID string, cmds []*QueuedCommand) error {
+	name := q.path(deviceID)
+	if len(cmds) == 0 {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, cmd := range cmds {
+		record, _ := json.Marshal(cmd)
+		w.Write(append(record, '\n'))
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, name)
+}
+
+// Len returns the number of commands queued for deviceID
+func (q *FileQueue) Len(deviceID string) int {
+	return q.mem.Len(deviceID)
+}
+
+func (q *FileQueue) Close() error {
+	return nil
+}
@@ -0,0 +1,100 @@
+package gotcp
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFileQueueReload(t *testing.T) {
+	dir := t.TempDir()
+	q, err := NewFileQueue(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for _, cmd := range []*QueuedCommand{
+		{ID: "1", DeviceID: "BED", Payload: []byte{1}},
+		{ID: "2", DeviceID: "BED", Payload: []byte{2}, Expires: now.Add(-time.Second)},
+		{ID: "3", DeviceID: "BED", Payload: []byte{3}},
+		{ID: "4", DeviceID: "OTHER", Payload: []byte{4}},
+	} {
+		if err := q.Push(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Push(&QueuedCommand{ID: "5", DeviceID: "BED"}); err != ErrQueueFull {
+		t.Fatalf("push past max depth: %v", err)
+	}
+
+	// a command peeked but without outcome survives a restart
+	head, _ := q.Peek("BED")
+	if head == nil || head.ID != "1" {
+		t.Fatalf("peek: %+v", head)
+	}
+
+	q, err = NewFileQueue(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := q.Len("BED"); n != 3 {
+		t.Fatalf("reloaded %d commands, want 3", n)
+	}
+
+	head, _ = q.Peek("BED")
+	if err := q.Remove(head); err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := q.Expire(now, func(id string) bool { return id == "OTHER" })
+	if err != nil || len(expired) != 1 || expired[0].ID != "2" {
+		t.Fatalf("expire: %v %v", expired, err)
+	}
+
+	q, err = NewFileQueue(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, _ = q.Peek("BED")
+	if head == nil || head.ID != "3" || head.Payload[0] != 3 || q.Len("BED") != 1 {
+		t.Fatalf("after remove and expire: %+v, %d queued", head, q.Len("BED"))
+	}
+	if q.Len("OTHER") != 1 {
+		t.Fatal("the skipped device lost its command")
+	}
+}
+
+func TestFileQueueTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	q, err := NewFileQueue(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Push(&QueuedCommand{ID: "1", DeviceID: "BED"})
+
+	// a crash while appending leaves half a record
+	f, err := os.OpenFile(q.path("BED"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(`{"ID":"2","Dev`))
+	f.Close()
+
+	q, err = NewFileQueue(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := q.Len("BED"); n != 1 {
+		t.Fatalf("reloaded %d commands, want 1", n)
+	}
+
+	q.Push(&QueuedCommand{ID: "3", DeviceID: "BED"})
+	q, err = NewFileQueue(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := q.Len("BED"); n != 2 {
+		t.Fatalf("reloaded %d commands after the torn one, want 2", n)
+	}
+}
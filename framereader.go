@@ -0,0 +1,174 @@
+package gotcp
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	frameReaderSize         = 4096
+	defaultMaxFrameSize     = 64 * 1024
+	maxConsecutiveEmptyRead = 100
+)
+
+var ErrFrameTooLarge = errors.New("frame larger than the read buffer limit")
+
+var frameReaderPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, frameReaderSize)
+		return &buf
+	},
+}
+
+// FrameReader is the read buffer owned by a Conn, a Protocol peeks at the
+// buffered bytes until a whole frame has arrived and then consumes it.
+// The slices returned by Peek and Bytes are only valid until the next call.
+type FrameReader struct {
+	rd      io.Reader
+	buf     []byte
+	r, w    int   // read and write positions in buf
+	err     error // the sticky error of rd
+	maxSize int   // the limit buf grows to
+	pooled  bool  // buf comes from frameReaderPool
+	total   int64 // the bytes read from rd, accessed atomically
+}
+
+// NewFrameReader returns a FrameReader reading from rd, so protocols
+// can be used on the client side too
+func NewFrameReader(rd io.Reader) *FrameReader {
+	return newFrameReader(rd, defaultMaxFrameSize)
+}
+
+func newFrameReader(rd io.Reader, maxSize int) *FrameReader {
+	if maxSize <= 0 {
+		maxSize = defaultMaxFrameSize
+	}
+
+	buf := frameReaderPool.Get().(*[]byte)
+	return &FrameReader{
+		rd:      rd,
+		buf:     *buf,
+		maxSize: maxSize,
+		pooled:  true,
+	}
+}
+
+// release gives the buffer back to the pool, f must not be used afterwards
+func (f *FrameReader) release() {
+	if f.pooled {
+		buf := f.buf[:cap(f.buf)]
+		frameReaderPool.Put(&buf)
+	}
+	f.buf = nil
+	f.r, f.w = 0, 0
+}
+
+// BytesRead returns the number of bytes read from rd so far, it is safe
+// to call from any goroutine
+func (f *FrameReader) BytesRead() int64 {
+	return atomic.LoadInt64(&f.total)
+}
+
+// Buffered returns the number of bytes that can be read without reading rd
+func (f *FrameReader) Buffered() int {
+	return f.w - f.r
+}
+
+// Bytes returns the buffered bytes without reading rd
+func (f *FrameReader) Bytes() []byte {
+	return f.buf[f.r:f.w]
+}
+
+// Fill reads rd once to buffer more bytes, the buffer grows up to the
+// frame size limit and ErrFrameTooLarge is returned once it is full
+func (f *FrameReader) Fill() error {
+	if f.err != nil {
+		return f.err
+	}
+
+	if f.r > 0 {
+		copy(f.buf, f.buf[f.r:f.w])
+		f.w -= f.r
+		f.r = 0
+	}
+
+	if f.w == len(f.buf) {
+		if len(f.buf) >= f.maxSize {
+			return ErrFrameTooLarge
+		}
+		size := 2 * len(f.buf)
+		if size > f.maxSize {
+			size = f.maxSize
+		}
+		buf := make([]byte, size)
+		w := copy(buf, f.buf[:f.w])
+		f.release()
+		f.buf, f.w, f.pooled = buf, w, false
+	}
+
+	for i := 0; i < maxConsecutiveEmptyRead; i++ {
+		n, err := f.rd.Read(f.buf[f.w:])
+		f.w += n
+		atomic.AddInt64(&f.total, int64(n))
+		if err != nil {
+			f.err = err
+			if n > 0 {
+				return nil
+			}
+			return err
+		}
+		if n > 0 {
+			return nil
+		}
+	}
+
+	f.err = io.ErrNoProgress
+	return f.err
+}
+
+// Peek returns the next n bytes without consuming them,
+// reading rd until they are buffered
+func (f *FrameReader) Peek(n int) ([]byte, error) {
+	if n > f.maxSize {
+		return nil, ErrFrameTooLarge
+	}
+
+	for f.w-f.r < n {
+		if err := f.Fill(); err != nil {
+			return nil, err
+		}
+	}
+
+	return f.buf[f.r : f.r+n], nil
+}
+
+// Discard skips the next n bytes, reading rd until they are buffered
+func (f *FrameReader) Discard(n int) error {
+	for f.w-f.r < n {
+		n -= f.w - f.r
+		f.r, f.w = 0, 0
+		if err := f.Fill(); err != nil {
+			return err
+		}
+	}
+
+	f.r += n
+	return nil
+}
+
+// Next consumes the next n bytes and returns a copy of them that the
+// caller owns, reading rd until they are buffered
+func (f *FrameReader) Next(n int) ([]byte, error) {
+	b, err := f.Peek(n)
+	if err != nil {
+		return nil, err
+	}
+
+	frame := make([]byte, n)
+	copy(frame, b)
+	f.r += n
+
+	return frame, nil
+}
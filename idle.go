@@ -0,0 +1,148 @@
+package gotcp
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var ErrIdleTimeout = errors.New("connection idle timeout")
+
+// IdleState tells which idle timeout expired
+type IdleState int
+
+const (
+	ReadIdle  IdleState = iota // nothing was read for Config.ReadIdleTimeout
+	WriteIdle                  // nothing was written for Config.WriteIdleTimeout
+	AllIdle                    // nothing was read or written for Config.IdleTimeout
+)
+
+func (s IdleState) String() string {
+	switch s {
+	case ReadIdle:
+		return "read idle"
+	case WriteIdle:
+		return "write idle"
+	case AllIdle:
+		return "all idle"
+	}
+
+	return "unknown"
+}
+
+// IdleCallback is an optional interface of ConnCallback, without it a
+// conn is closed with ErrIdleTimeout when an idle timeout expires
+type IdleCallback interface {
+	// OnIdle is called when an idle timeout expires, it is called again
+	// after another timeout without activity,
+	// If the return value of false is closed
+	OnIdle(*Conn, IdleState) bool
+}
+
+// idleTick returns the interval of the timing wheel for config,
+// 0 if no idle timeout is configured
+func idleTick(config *Config) time.Duration {
+	var tick time.Duration
+	for _, d := range []time.Duration{config.ReadIdleTimeout, config.WriteIdleTimeout, config.IdleTimeout} {
+		if d <= 0 {
+			continue
+		}
+		if tick == 0 {
+			tick = time.Second
+		}
+		if d/4 < tick {
+			tick = d / 4
+		}
+	}
+
+	if tick > 0 && tick < 10*time.Millisecond {
+		tick = 10 * time.Millisecond
+	}
+
+	return tick
+}
+
+// touchRead marks the conn as read now and returns now
+func (c *Conn) touchRead() int64 {
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&c.lastRead, now)
+	return now
+}
+
+// touchWrite marks the conn as written now
+func (c *Conn) touchWrite() {
+	atomic.StoreInt64(&c.lastWrite, time.Now().UnixNano())
+}
+
+// scheduleIdle schedules the next idle check after d
+func (c *Conn) scheduleIdle(d time.Duration) {
+	c.idleLock.Lock()
+	if !c.IsClosed() {
+		c.idleTimer = c.srv.wheel.AfterFunc(d, c.checkIdle)
+	}
+	c.idleLock.Unlock()
+}
+
+// stopIdle cancels the pending idle check
+func (c *Conn) stopIdle() {
+	c.idleLock.Lock()
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+		c.idleTimer = nil
+	}
+	c.idleLock.Unlock()
+}
+
+// checkIdle fires the expired idle states and schedules the next check
+func (c *Conn) checkIdle() {
+	if c.IsClosed() {
+		return
+	}
+
+	config := c.srv.config
+	lastRead := atomic.LoadInt64(&c.lastRead)
+	lastWrite := atomic.LoadInt64(&c.lastWrite)
+	lastAll := lastRead
+	if lastWrite > lastAll {
+		lastAll = lastWrite
+	}
+
+	now := time.Now().UnixNano()
+	next := time.Duration(-1)
+	for state, timeout := range [...]time.Duration{config.ReadIdleTimeout, config.WriteIdleTimeout, config.IdleTimeout} {
+		if timeout <= 0 {
+			continue
+		}
+
+		since := [...]int64{lastRead, lastWrite, lastAll}[state]
+		if c.idleFired[state] > since {
+			since = c.idleFired[state]
+		}
+
+		left := timeout - time.Duration(now-since)
+		if left <= 0 {
+			if !c.onIdle(IdleState(state)) {
+				c.close(CloseReason{Kind: CloseIdle, Err: ErrIdleTimeout})
+				return
+			}
+			c.idleFired[state] = now
+			left = timeout
+		}
+
+		if next < 0 || left < next {
+			next = left
+		}
+	}
+
+	if next > 0 {
+		c.scheduleIdle(next)
+	}
+}
+
+func (c *Conn) onIdle(state IdleState) bool {
+	if cb, ok := c.srv.callback.(IdleCallback); ok {
+		return cb.OnIdle(c, state)
+	}
+
+	return false
+}
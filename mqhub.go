@@ -1,17 +1,26 @@
 package gotcp
 
 import (
+	"errors"
 	"log"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/bitly/go-nsq"
+	"github.com/giskook/gotcp/envelope"
 )
 
+var ErrNoBroker = errors.New("mqhub has no broker")
+
 type MqConfig struct {
 	Addr    string
 	Topic   string
 	Channel string
+
+	WriteTimeout time.Duration // how long Subscribe waits for a full write queue, 1s if 0
+	Spool        *SpoolConfig  // where the failed publishes wait for the broker, lost if nil
+
+	Envelope *envelope.Codec // the encoding of the envelopes by topic, Raw if nil
 }
 
 type Mqhub struct {
@@ -19,30 +28,50 @@ type Mqhub struct {
 	protocol  Protocol
 	waitGroup *sync.WaitGroup
 
-	producer *nsq.Producer
-	//consumer *nsq.Consumer
-	conns    map[uint32]*Conn
-	connsmac map[string]uint32
+	broker     Broker
+	spool      *Spool
+	spoolErr   error // why the configured spool could not be opened
+	registry   *Registry
+	downstream DownstreamHandler // see OnDownstream
 }
 
+// Newmqhub creates a mqhub publishing to the nsqd at config.Addr once started
 func Newmqhub(config *MqConfig, protocol Protocol) *Mqhub {
+	return NewmqhubWithBroker(config, protocol, nil)
+}
+
+// NewmqhubWithBroker creates a mqhub using broker, such as a MemoryBroker,
+// a NSQBroker for config.Addr is created by Start if broker is nil
+func NewmqhubWithBroker(config *MqConfig, protocol Protocol, broker Broker) *Mqhub {
 	return &Mqhub{
 		config:    config,
 		protocol:  protocol,
 		waitGroup: &sync.WaitGroup{},
-		conns:     make(map[uint32]*Conn),
-		connsmac:  make(map[string]uint32),
+		broker:    broker,
+		registry:  NewRegistry(),
 	}
 }
 
 func (q *Mqhub) Start() {
 	q.waitGroup.Add(1)
-	config := nsq.NewConfig()
-	var errormsg error
-	q.producer, errormsg = nsq.NewProducer(q.config.Addr, config)
-	//q.Send(q.config.Topic, []byte("abc"))
-	if errormsg != nil {
-		log.Printf("create producer error")
+	if q.broker == nil {
+		broker, err := NewNSQBroker(q.config.Addr)
+		if err != nil {
+			log.Printf("create producer error: %v", err)
+		} else {
+			q.broker = broker
+		}
+	}
+
+	if q.config.Spool != nil {
+		spool, err := OpenSpool(q.config.Spool, q.publish)
+		if err != nil {
+			// Send fails rather than publish without the spool
+			log.Printf("open spool error: %v", err)
+			q.spoolErr = err
+			return
+		}
+		q.spool = spool
 	}
 }
 
@@ -50,35 +79,97 @@ func (q *Mqhub) Stop() {
 	q.waitGroup.Done()
 	q.waitGroup.Wait()
 
-	q.producer.Stop()
-	//q.consumer.Stop()
+	if q.spool != nil {
+		q.spool.Close()
+	}
+	if q.broker != nil {
+		q.broker.Close()
+	}
 }
 
+// Send publishes value to topic. With a spool, a failed publish is spooled
+// and replayed in order once the broker is back, the error is only returned
+// if it could not be spooled either. If the configured spool could not be
+// opened by Start, Send fails with that error instead of losing messages.
 func (q *Mqhub) Send(topic string, value []byte) error {
-	err := q.producer.Publish(topic, value)
+	if q.spoolErr != nil {
+		return q.spoolErr
+	}
+	if q.spool != nil {
+		return q.spool.Publish(topic, value)
+	}
+
+	return q.publish(topic, value)
+}
+
+// Publish publishes e to topic in the encoding configured for topic
+func (q *Mqhub) Publish(topic string, e *envelope.Envelope) error {
+	encoding := envelope.Raw
+	if q.config.Envelope != nil {
+		encoding = q.config.Envelope.Encoding(topic)
+	}
+
+	return q.publishEnvelope(topic, e, encoding)
+}
+
+func (q *Mqhub) publishEnvelope(topic string, e *envelope.Envelope, encoding envelope.Encoding) error {
+	body, err := envelope.Marshal(e, encoding)
+	if err != nil {
+		return err
+	}
 
-	return err
+	return q.Send(topic, body)
+}
+
+func (q *Mqhub) publish(topic string, value []byte) error {
+	if q.broker == nil {
+		return ErrNoBroker
+	}
+
+	return q.broker.Publish(topic, value)
+}
+
+// SpoolStats returns the depth and age of the spool, zero without one
+func (q *Mqhub) SpoolStats() SpoolStats {
+	if q.spool == nil {
+		return SpoolStats{}
+	}
+
+	return q.spool.Stats()
+}
+
+// Broker returns the broker of q, nil until started if it was not given
+func (q *Mqhub) Broker() Broker {
+	return q.broker
+}
+
+// Healthy returns nil if q can publish
+func (q *Mqhub) Healthy() error {
+	if q.spoolErr != nil {
+		return q.spoolErr
+	}
+	if q.broker == nil {
+		return ErrNoBroker
+	}
+
+	return q.broker.Healthy()
 }
 
 func (q *Mqhub) Exist(id string) bool {
 	idupper := strings.ToUpper(id)
-	_, ok := q.connsmac[idupper]
 
-	return ok
+	return q.registry.GetByID(idupper) != nil
 }
 
 func (q *Mqhub) GetConn(mac string) *Conn {
+	return q.registry.GetByID(mac)
+}
 
-	log.Println(q.conns)
-	log.Println(q.connsmac)
-	return q.conns[q.connsmac[mac]]
+// Registry returns the registry shared with the servers using q
+func (q *Mqhub) Registry() *Registry {
+	return q.registry
 }
 
 func (q *Mqhub) GetAddr() string {
 	return q.config.Addr
 }
-
-func (q *Mqhub) RemoveConn(index uint32, mac string) {
-	delete(q.conns, index)
-	delete(q.connsmac, mac)
-}
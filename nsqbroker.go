@@ -0,0 +1,76 @@
+package gotcp
+
+import (
+	"sync"
+
+	"github.com/bitly/go-nsq"
+)
+
+// NSQBroker is a Broker publishing to and consuming from a single nsqd
+type NSQBroker struct {
+	addr     string
+	config   *nsq.Config
+	producer *nsq.Producer
+
+	lock      sync.Mutex
+	consumers []*nsq.Consumer
+}
+
+// NewNSQBroker creates a broker for the nsqd at addr
+func NewNSQBroker(addr string) (*NSQBroker, error) {
+	config := nsq.NewConfig()
+	producer, err := nsq.NewProducer(addr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NSQBroker{
+		addr:     addr,
+		config:   config,
+		producer: producer,
+	}, nil
+}
+
+func (b *NSQBroker) Publish(topic string, body []byte) error {
+	return b.producer.Publish(topic, body)
+}
+
+func (b *NSQBroker) Subscribe(topic, channel string, handler MessageHandler) error {
+	consumer, err := nsq.NewConsumer(topic, channel, b.config)
+	if err != nil {
+		return err
+	}
+
+	consumer.AddHandler(nsq.HandlerFunc(func(message *nsq.Message) error {
+		return handler(message.Body)
+	}))
+	if err := consumer.ConnectToNSQD(b.addr); err != nil {
+		consumer.Stop()
+		return err
+	}
+
+	b.lock.Lock()
+	b.consumers = append(b.consumers, consumer)
+	b.lock.Unlock()
+
+	return nil
+}
+
+func (b *NSQBroker) Healthy() error {
+	return b.producer.Ping()
+}
+
+func (b *NSQBroker) Close() error {
+	b.lock.Lock()
+	consumers := b.consumers
+	b.consumers = nil
+	b.lock.Unlock()
+
+	for _, consumer := range consumers {
+		consumer.Stop()
+		<-consumer.StopChan
+	}
+	b.producer.Stop()
+
+	return nil
+}
@@ -0,0 +1,173 @@
+package gotcp
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrQueueFull = errors.New("offline queue full")
+
+// QueuedCommand is a command waiting for its device to log in, it keeps the
+// broker message of the command so a file backed queue can store it
+type QueuedCommand struct {
+	ID       string
+	DeviceID string
+	Topic    string
+	Payload  []byte    // the broker message the command was decoded from
+	Expires  time.Time // the command expires at, never if zero
+}
+
+func (q *QueuedCommand) expired(now time.Time) bool {
+	return !q.Expires.IsZero() && !now.Before(q.Expires)
+}
+
+// OfflineQueue holds the commands of offline devices per device ID,
+// in the order they were pushed. A command is peeked while it is
+// delivered and only removed once it has an outcome.
+type OfflineQueue interface {
+	// Push queues cmd, ErrQueueFull if its device has too many queued
+	Push(cmd *QueuedCommand) error
+
+	// Peek returns the first command queued for deviceID, nil if none
+	Peek(deviceID string) (*QueuedCommand, error)
+
+	// Remove removes cmd, as returned by Peek
+	Remove(cmd *QueuedCommand) error
+
+	// Expire removes and returns the commands expired at now,
+	// except those of the devices skip returns true for
+	Expire(now time.Time, skip func(deviceID string) bool) ([]*QueuedCommand, error)
+
+	Close() error
+}
+
+// MemoryQueue is an OfflineQueue lost on restart
+type MemoryQueue struct {
+	maxDepth int
+
+	lock   sync.Mutex
+	queues map[string][]*QueuedCommand
+}
+
+// NewMemoryQueue creates a queue holding at most maxDepth commands
+// per device, unlimited if maxDepth <= 0
+func NewMemoryQueue(maxDepth int) *MemoryQueue {
+	return &MemoryQueue{
+		maxDepth: maxDepth,
+		queues:   make(map[string][]*QueuedCommand),
+	}
+}
+
+func (q *MemoryQueue) Push(cmd *QueuedCommand) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	queue := q.queues[cmd.DeviceID]
+	if q.maxDepth > 0 && len(queue) >= q.maxDepth {
+		return ErrQueueFull
+	}
+	q.queues[cmd.DeviceID] = append(queue, cmd)
+
+	return nil
+}
+
+func (q *MemoryQueue) Peek(deviceID string) (*QueuedCommand, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if queue := q.queues[deviceID]; len(queue) > 0 {
+		return queue[0], nil
+	}
+
+	return nil, nil
+}
+
+func (q *MemoryQueue) Remove(cmd *QueuedCommand) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	queue := q.queues[cmd.DeviceID]
+	for i := range queue {
+		if queue[i] != cmd {
+			continue
+		}
+
+		if len(queue) == 1 {
+			delete(q.queues, cmd.DeviceID)
+		} else {
+			// copied, the slices returned by queue stay valid
+			q.queues[cmd.DeviceID] = append(queue[:i:i], queue[i+1:]...)
+		}
+		break
+	}
+
+	return nil
+}
+
+func (q *MemoryQueue) Expire(now time.Time, skip func(deviceID string) bool) ([]*QueuedCommand, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var expired []*QueuedCommand
+	for id, queue := range q.queues {
+		if skip != nil && skip(id) {
+			continue
+		}
+
+		live := queue[:0]
+		for _, cmd := range queue {
+			if cmd.expired(now) {
+				expired = append(expired, cmd)
+			} else {
+				live = append(live, cmd)
+			}
+		}
+
+		if len(live) == 0 {
+			delete(q.queues, id)
+		} else {
+			q.queues[id] = live
+		}
+	}
+
+	return expired, nil
+}
+
+// queue returns the commands queued for deviceID
+func (q *MemoryQueue) queue(deviceID string) []*QueuedCommand {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.queues[deviceID]
+}
+
+// pop removes the last command queued for deviceID and returns the rest
+func (q *MemoryQueue) pop(deviceID string) []*QueuedCommand {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	queue := q.queues[deviceID]
+	if len(queue) > 0 {
+		queue = queue[:len(queue)-1]
+	}
+	if len(queue) == 0 {
+		delete(q.queues, deviceID)
+	} else {
+		q.queues[deviceID] = queue
+	}
+
+	return queue
+}
+
+// Len returns the number of commands queued for deviceID
+func (q *MemoryQueue) Len(deviceID string) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return len(q.queues[deviceID])
+}
+
+func (q *MemoryQueue) Close() error {
+	return nil
+}
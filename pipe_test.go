@@ -0,0 +1,153 @@
+package gotcp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeListener accepts the server ends of net.Pipe conns made by Dial
+type pipeListener struct {
+	conns     chan net.Conn
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// Dial returns the client end of a conn accepted by the listener
+func (l *pipeListener) Dial() net.Conn {
+	server, client := net.Pipe()
+	l.conns <- server
+	return client
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// linePacket is a "kind arg" text line, CMD and ACK lines are
+// correlated by their arg
+type linePacket struct {
+	kind string
+	arg  string
+}
+
+func (p *linePacket) Serialize() []byte {
+	return []byte(p.kind + " " + p.arg + "\n")
+}
+
+func (p *linePacket) CorrelationKey() (interface{}, bool) {
+	return p.arg, p.kind == "CMD" || p.kind == "ACK"
+}
+
+func splitLine(line string) (string, string) {
+	fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+	if len(fields) < 2 {
+		return fields[0], ""
+	}
+	return fields[0], fields[1]
+}
+
+type lineProtocol struct{}
+
+func (lineProtocol) ReadPacket(c *Conn) (Packet, error) {
+	r := c.Reader()
+	for {
+		if i := bytes.IndexByte(r.Bytes(), '\n'); i >= 0 {
+			line, err := r.Next(i + 1)
+			if err != nil {
+				return nil, err
+			}
+			kind, arg := splitLine(string(line))
+			return &linePacket{kind: kind, arg: arg}, nil
+		}
+		if err := r.Fill(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// lineCallback binds the conns with "LOGIN id" lines
+type lineCallback struct{}
+
+func (lineCallback) OnConnect(c *Conn) bool { return true }
+
+func (lineCallback) OnMessage(c *Conn, p Packet) bool {
+	if lp := p.(*linePacket); lp.kind == "LOGIN" {
+		return c.SetID(lp.arg, c.GetIndex()) == nil
+	}
+	return true
+}
+
+func (lineCallback) OnClose(c *Conn) {}
+
+// startLineServer serves lineProtocol over pipes for mqhub
+func startLineServer(t *testing.T, config *Config, mqhub *Mqhub) (*Server, *pipeListener) {
+	return startPipeServer(t, config, lineCallback{}, mqhub)
+}
+
+// startPipeServer serves lineProtocol over pipes with callback
+func startPipeServer(t *testing.T, config *Config, callback ConnCallback, mqhub *Mqhub) (*Server, *pipeListener) {
+	if config.PacketSendChanLimit == 0 {
+		config.PacketSendChanLimit = 16
+	}
+	if config.PacketReceiveChanLimit == 0 {
+		config.PacketReceiveChanLimit = 16
+	}
+
+	srv := NewServer(config, callback, lineProtocol{}, mqhub)
+	l := newPipeListener()
+	go srv.Start(l, 10*time.Millisecond)
+	t.Cleanup(srv.Stop)
+
+	return srv, l
+}
+
+// lineDevice logs in as id and acks every CMD line, the args of the
+// commands received are sent to cmds
+func lineDevice(l *pipeListener, id string, cmds chan<- string) net.Conn {
+	conn := l.Dial()
+	go func() {
+		conn.Write([]byte("LOGIN " + id + "\n"))
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			kind, arg := splitLine(scanner.Text())
+			if kind != "CMD" {
+				continue
+			}
+			cmds <- arg
+			if _, err := conn.Write([]byte("ACK " + arg + "\n")); err != nil {
+				return
+			}
+		}
+	}()
+
+	return conn
+}
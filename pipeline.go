@@ -0,0 +1,169 @@
+package gotcp
+
+import "time"
+
+// InboundHandler is a stage of the inbound pipeline, it handles the packets
+// read by the Protocol before they complete a request or reach
+// ConnCallback.OnMessage
+type InboundHandler interface {
+	// HandleRead passes p, or the packet it turns p into, to the next stage
+	// with ctx.FireRead. Not calling FireRead drops the packet. Returning
+	// an error closes the conn.
+	HandleRead(ctx *HandlerContext, p Packet) error
+}
+
+// OutboundHandler is a stage of the outbound pipeline, it handles the
+// packets passed to WritePacket before they are queued for the writer
+type OutboundHandler interface {
+	// HandleWrite passes p, or the packet it turns p into, to the next
+	// stage with ctx.FireWrite. Not calling FireWrite drops the packet.
+	// The error is returned to the caller of WritePacket.
+	HandleWrite(ctx *HandlerContext, p Packet) error
+}
+
+// EventHandler is an optional interface of an InboundHandler,
+// it receives the events fired with HandlerContext.FireEvent
+type EventHandler interface {
+	// HandleEvent passes the event on with ctx.FireEvent, or drops it
+	HandleEvent(ctx *HandlerContext, event interface{}) error
+}
+
+// EventCallback is an optional interface of ConnCallback, OnEvent receives
+// the events that went through the whole inbound pipeline
+type EventCallback interface {
+	OnEvent(*Conn, interface{})
+}
+
+// InboundHandlerFunc adapts a function to an InboundHandler
+type InboundHandlerFunc func(ctx *HandlerContext, p Packet) error
+
+func (f InboundHandlerFunc) HandleRead(ctx *HandlerContext, p Packet) error {
+	return f(ctx, p)
+}
+
+// OutboundHandlerFunc adapts a function to an OutboundHandler
+type OutboundHandlerFunc func(ctx *HandlerContext, p Packet) error
+
+func (f OutboundHandlerFunc) HandleWrite(ctx *HandlerContext, p Packet) error {
+	return f(ctx, p)
+}
+
+type namedInbound struct {
+	name    string
+	handler InboundHandler
+}
+
+type namedOutbound struct {
+	name    string
+	handler OutboundHandler
+}
+
+// Pipeline is the chain of handlers of a Server. Inbound handlers run in
+// the order they were added, from the Protocol towards OnMessage. Outbound
+// handlers run in the order they were added, from WritePacket towards the
+// writer. Handlers are shared by all the conns and must be added before
+// the server starts.
+type Pipeline struct {
+	inbound  []namedInbound
+	outbound []namedOutbound
+}
+
+// AddInbound appends an inbound handler
+func (p *Pipeline) AddInbound(name string, h InboundHandler) *Pipeline {
+	p.inbound = append(p.inbound, namedInbound{name, h})
+	return p
+}
+
+// AddOutbound appends an outbound handler
+func (p *Pipeline) AddOutbound(name string, h OutboundHandler) *Pipeline {
+	p.outbound = append(p.outbound, namedOutbound{name, h})
+	return p
+}
+
+// HandlerContext is passed to a handler to reach the conn and the next stage
+type HandlerContext struct {
+	conn     *Conn
+	pipeline *Pipeline
+	index    int    // the index of the handler in its chain
+	name     string // the name of the handler
+
+	priority Priority      // the priority the packet is written with
+	timeout  time.Duration // the timeout the packet is written with
+}
+
+// Conn returns the connection the packet belongs to
+func (ctx *HandlerContext) Conn() *Conn {
+	return ctx.conn
+}
+
+// Name returns the name the handler was added with
+func (ctx *HandlerContext) Name() string {
+	return ctx.name
+}
+
+// FireRead passes p to the next inbound stage
+func (ctx *HandlerContext) FireRead(p Packet) error {
+	return ctx.pipeline.read(ctx.conn, ctx.index+1, p)
+}
+
+// FireWrite passes p to the next outbound stage
+func (ctx *HandlerContext) FireWrite(p Packet) error {
+	return ctx.pipeline.write(ctx.conn, ctx.index+1, p, ctx.priority, ctx.timeout)
+}
+
+// FireEvent passes event to the next inbound stages implementing
+// EventHandler, then to EventCallback
+func (ctx *HandlerContext) FireEvent(event interface{}) error {
+	return ctx.pipeline.event(ctx.conn, ctx.index+1, event)
+}
+
+// FireEvent passes event through the inbound pipeline of c
+func (c *Conn) FireEvent(event interface{}) error {
+	return c.srv.pipeline.event(c, 0, event)
+}
+
+func (p *Pipeline) read(c *Conn, i int, packet Packet) error {
+	if i >= len(p.inbound) {
+		if c.completeRequest(packet) {
+			return nil
+		}
+		if !c.srv.callback.OnMessage(c, packet) {
+			return ErrRejected
+		}
+		return nil
+	}
+
+	h := p.inbound[i]
+	return h.handler.HandleRead(&HandlerContext{conn: c, pipeline: p, index: i, name: h.name}, packet)
+}
+
+func (p *Pipeline) write(c *Conn, i int, packet Packet, priority Priority, timeout time.Duration) error {
+	if i >= len(p.outbound) {
+		return c.enqueue(packet, priority, timeout)
+	}
+
+	h := p.outbound[i]
+	return h.handler.HandleWrite(&HandlerContext{
+		conn:     c,
+		pipeline: p,
+		index:    i,
+		name:     h.name,
+		priority: priority,
+		timeout:  timeout,
+	}, packet)
+}
+
+func (p *Pipeline) event(c *Conn, i int, event interface{}) error {
+	for ; i < len(p.inbound); i++ {
+		h := p.inbound[i]
+		if eh, ok := h.handler.(EventHandler); ok {
+			return eh.HandleEvent(&HandlerContext{conn: c, pipeline: p, index: i, name: h.name}, event)
+		}
+	}
+
+	if cb, ok := c.srv.callback.(EventCallback); ok {
+		cb.OnEvent(c, event)
+	}
+
+	return nil
+}
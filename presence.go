@@ -0,0 +1,76 @@
+package gotcp
+
+import (
+	"encoding/json"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/giskook/gotcp/envelope"
+)
+
+// The presence events, the Type of the envelopes published to Config.PresenceTopic
+const (
+	PresenceAccepted = "accepted" // the conn was accepted, after the TLS handshake
+	PresenceBound    = "bound"    // a device ID was bound to the conn
+	PresenceRebound  = "rebound"  // a device ID moved to the conn from another one
+	PresenceClosed   = "closed"   // the conn was closed
+)
+
+// Presence is the JSON payload of a presence event
+type Presence struct {
+	Reason       string `json:"reason,omitempty"`        // why the conn was closed
+	Previous     uint64 `json:"previous_conn,omitempty"` // the conn the device ID was bound to before a rebound
+	TakenOver    bool   `json:"taken_over,omitempty"`    // the device ID of the closed conn was rebound to another conn
+	Duration     int64  `json:"duration_ms"`             // how long the conn has been open
+	BytesRead    int64  `json:"bytes_read"`
+	BytesWritten uint64 `json:"bytes_written"`
+}
+
+// publishPresence publishes event for the device ID id, if the server
+// has a PresenceTopic and a mqhub. A raw presence event could not be told
+// apart from the others, so Raw topics get JSON envelopes.
+func (c *Conn) publishPresence(event string, id string, p *Presence) {
+	topic := c.srv.config.PresenceTopic
+	if topic == "" || c.srv.mqhub == nil {
+		return
+	}
+
+	if event == PresenceAccepted {
+		atomic.StoreInt32(&c.presenceFlag, 1)
+	} else if atomic.LoadInt32(&c.presenceFlag) == 0 {
+		// the conn never made it past the handshake
+		return
+	}
+
+	now := time.Now()
+	p.Duration = int64(now.Sub(c.start) / time.Millisecond)
+	p.BytesRead = c.reader.BytesRead()
+	p.BytesWritten = c.writeStats.load().Bytes
+	payload, _ := json.Marshal(p)
+
+	e := &envelope.Envelope{
+		DeviceID: id,
+		ConnID:   c.index,
+		Time:     now,
+		Type:     event,
+		Payload:  payload,
+	}
+	if addr := c.conn.RemoteAddr(); addr != nil {
+		e.RemoteAddr = addr.String()
+	}
+
+	if err := c.srv.mqhub.publishEnvelope(topic, e, presenceEncoding(c.srv.mqhub, topic)); err != nil {
+		log.Printf("publish presence %s of conn %d: %v", event, c.index, err)
+	}
+}
+
+// presenceEncoding is the encoding of the presence events, they are
+// always whole envelopes, JSON unless topic is configured as protobuf
+func presenceEncoding(q *Mqhub, topic string) envelope.Encoding {
+	if q.config.Envelope != nil && q.config.Envelope.Encoding(topic) == envelope.Protobuf {
+		return envelope.Protobuf
+	}
+
+	return envelope.JSON
+}
@@ -0,0 +1,107 @@
+package gotcp
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/giskook/gotcp/envelope"
+)
+
+func TestPresenceClosedTakenOver(t *testing.T) {
+	broker := NewMemoryBroker()
+	q := NewmqhubWithBroker(&MqConfig{Envelope: &envelope.Codec{Default: envelope.JSON}}, nil, broker)
+	q.Start()
+	defer q.Stop()
+	_, l := startLineServer(t, &Config{PresenceTopic: "presence"}, q)
+
+	events := make(chan *envelope.Envelope, 16)
+	broker.Subscribe("presence", "test", func(body []byte) error {
+		e, err := envelope.Unmarshal(body, envelope.JSON)
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		if e.Type == PresenceClosed {
+			events <- e
+		}
+		return nil
+	})
+
+	closed := func() (*envelope.Envelope, *Presence) {
+		select {
+		case e := <-events:
+			p := &Presence{}
+			if err := json.Unmarshal(e.Payload, p); err != nil {
+				t.Fatal(err)
+			}
+			return e, p
+		case <-time.After(2 * time.Second):
+			t.Fatal("no closed event")
+		}
+		return nil, nil
+	}
+
+	old := lineDevice(l, "BED", nil)
+	defer old.Close()
+	waitBound(t, q, "BED", nil)
+	first := q.GetConn("BED")
+
+	// the new login kicks the old conn, its closed event must not carry the ID
+	current := lineDevice(l, "BED", nil)
+	defer current.Close()
+	e, p := closed()
+	if e.ConnID != first.GetIndex() || e.DeviceID != "" || !p.TakenOver {
+		t.Fatalf("closed conn %d: device %q taken over %v", e.ConnID, e.DeviceID, p.TakenOver)
+	}
+
+	second := q.GetConn("BED")
+	current.Close()
+	e, p = closed()
+	if e.ConnID != second.GetIndex() || e.DeviceID != "BED" || p.TakenOver {
+		t.Fatalf("closed conn %d: device %q taken over %v", e.ConnID, e.DeviceID, p.TakenOver)
+	}
+}
+
+// waitBound waits until id is bound to a conn other than not
+func waitBound(t *testing.T, q *Mqhub, id string, not *Conn) {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if c := q.GetConn(id); c != nil && c != not {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s not bound", id)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestPresenceRawTopic checks a mqhub without envelope encodings still
+// publishes whole envelopes, or the events could not be told apart
+func TestPresenceRawTopic(t *testing.T) {
+	broker := NewMemoryBroker()
+	q := NewmqhubWithBroker(&MqConfig{}, nil, broker)
+	q.Start()
+	defer q.Stop()
+	_, l := startLineServer(t, &Config{PresenceTopic: "presence"}, q)
+
+	events := consume(t, broker, "presence")
+	conn := lineDevice(l, "BED", nil)
+	waitBound(t, q, "BED", nil)
+	conn.Close()
+
+	for _, expected := range []struct{ event, id string }{
+		{PresenceAccepted, ""},
+		{PresenceBound, "BED"},
+		{PresenceClosed, "BED"},
+	} {
+		e, err := envelope.Unmarshal([]byte(receive(t, events, expected.event)), envelope.JSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Type != expected.event || e.DeviceID != expected.id || e.ConnID == 0 || e.RemoteAddr != "pipe" {
+			t.Fatalf("%s event: %+v", expected.event, e)
+		}
+	}
+}
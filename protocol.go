@@ -4,6 +4,24 @@ type Packet interface {
 	Serialize() []byte
 }
 
+// Encoder is an optional interface of Packet, the writer prefers it to
+// Serialize. AppendTo appends the encoded packet to buf, which belongs to
+// the writer, and returns the extended buffer. On error the packet is not
+// written and the error is reported to ErrorCallback.
+type Encoder interface {
+	AppendTo(buf []byte) ([]byte, error)
+}
+
+// EncodeError is the error reported when a packet can not be encoded
+type EncodeError struct {
+	Packet Packet
+	Err    error
+}
+
+func (e *EncodeError) Error() string {
+	return "encode packet: " + e.Err.Error()
+}
+
 type Protocol interface {
 	ReadPacket(conn *Conn) (Packet, error)
 }
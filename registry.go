@@ -0,0 +1,298 @@
+package gotcp
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+const registryShards = 32
+
+var (
+	ErrConnNotFound   = errors.New("connection not registered")
+	ErrDuplicateLogin = errors.New("device ID already bound to another connection")
+)
+
+// Registry is a lock sharded index of the live connections, they can be
+// looked up by index and by the device ID bound with Bind
+type Registry struct {
+	conns [registryShards]connShard
+	ids   [registryShards]idShard
+	count int64
+
+	lastIndex uint64 // the last index handed out by NextIndex
+	lastGen   uint64 // the generation of the last binding
+
+	callbackLock sync.RWMutex
+	onAdd        []func(*Conn)
+	onRemove     []func(*Conn)
+	onBind       []func(string, *Conn)
+}
+
+type registryEntry struct {
+	conn *Conn
+	id   string // the device ID bound to conn, "" if none
+	gen  uint64 // the generation of the binding of id
+}
+
+// binding is a device ID to conn mapping, gen tells apart every
+// binding so a stale conn can never remove a newer one
+type binding struct {
+	conn *Conn
+	gen  uint64
+}
+
+type connShard struct {
+	sync.RWMutex
+	m map[uint64]*registryEntry
+}
+
+type idShard struct {
+	sync.RWMutex
+	m map[string]binding
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	r := &Registry{}
+	for i := 0; i < registryShards; i++ {
+		r.conns[i].m = make(map[uint64]*registryEntry)
+		r.ids[i].m = make(map[string]binding)
+	}
+
+	return r
+}
+
+// NextIndex returns a new connection index, indexes are never reused
+func (r *Registry) NextIndex() uint64 {
+	return atomic.AddUint64(&r.lastIndex, 1)
+}
+
+func (r *Registry) connShard(index uint64) *connShard {
+	return &r.conns[index%registryShards]
+}
+
+func (r *Registry) idShard(id string) *idShard {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return &r.ids[h.Sum32()%registryShards]
+}
+
+// OnAdd registers f to be called after a conn is added
+func (r *Registry) OnAdd(f func(*Conn)) {
+	r.callbackLock.Lock()
+	r.onAdd = append(r.onAdd, f)
+	r.callbackLock.Unlock()
+}
+
+// OnRemove registers f to be called after a conn is removed
+func (r *Registry) OnRemove(f func(*Conn)) {
+	r.callbackLock.Lock()
+	r.onRemove = append(r.onRemove, f)
+	r.callbackLock.Unlock()
+}
+
+// OnBind registers f to be called after a device ID is bound to a conn
+func (r *Registry) OnBind(f func(id string, c *Conn)) {
+	r.callbackLock.Lock()
+	r.onBind = append(r.onBind, f)
+	r.callbackLock.Unlock()
+}
+
+func (r *Registry) fire(callbacks *[]func(*Conn), c *Conn) {
+	r.callbackLock.RLock()
+	fs := *callbacks
+	r.callbackLock.RUnlock()
+
+	for _, f := range fs {
+		f(c)
+	}
+}
+
+// Add registers c under its index
+func (r *Registry) Add(c *Conn) {
+	shard := r.connShard(c.index)
+	shard.Lock()
+	shard.m[c.index] = &registryEntry{conn: c}
+	shard.Unlock()
+
+	atomic.AddInt64(&r.count, 1)
+	r.fire(&r.onAdd, c)
+}
+
+// Remove removes c and the device ID bound to it, if c is still registered
+func (r *Registry) Remove(c *Conn) {
+	shard := r.connShard(c.index)
+	shard.Lock()
+	e, ok := shard.m[c.index]
+	if !ok || e.conn != c {
+		shard.Unlock()
+		return
+	}
+	delete(shard.m, c.index)
+	if e.id != "" {
+		r.unbindLocked(e.id, e.gen)
+	}
+	shard.Unlock()
+
+	atomic.AddInt64(&r.count, -1)
+	r.fire(&r.onRemove, c)
+}
+
+// Bind binds the device ID id to c, replacing any other ID bound to c. If id
+// is bound to another conn, the binding is replaced when replace is true and
+// ErrDuplicateLogin is returned otherwise. It returns the conn id was bound
+// to before and the generation of the new binding.
+func (r *Registry) Bind(id string, c *Conn, replace bool) (*Conn, uint64, error) {
+	old, gen, err := r.bind(id, c, replace)
+	if err != nil {
+		return old, gen, err
+	}
+
+	r.callbackLock.RLock()
+	fs := r.onBind
+	r.callbackLock.RUnlock()
+
+	for _, f := range fs {
+		f(id, c)
+	}
+
+	return old, gen, nil
+}
+
+func (r *Registry) bind(id string, c *Conn, replace bool) (*Conn, uint64, error) {
+	shard := r.connShard(c.index)
+	shard.Lock()
+	defer shard.Unlock()
+
+	e, ok := shard.m[c.index]
+	if !ok || e.conn != c {
+		return nil, 0, ErrConnNotFound
+	}
+
+	ids := r.idShard(id)
+	ids.Lock()
+	old := ids.m[id].conn
+	if old != nil && old != c && !replace {
+		ids.Unlock()
+		return old, 0, ErrDuplicateLogin
+	}
+	gen := atomic.AddUint64(&r.lastGen, 1)
+	ids.m[id] = binding{conn: c, gen: gen}
+	ids.Unlock()
+
+	if e.id != "" && e.id != id {
+		r.unbindLocked(e.id, e.gen)
+	}
+	e.id = id
+	e.gen = gen
+
+	return old, gen, nil
+}
+
+// Unbind removes the binding of id, only if it is still the binding of
+// generation gen returned by Bind
+func (r *Registry) Unbind(id string, gen uint64) {
+	ids := r.idShard(id)
+	ids.RLock()
+	b, ok := ids.m[id]
+	ids.RUnlock()
+	if !ok || b.gen != gen {
+		return
+	}
+
+	shard := r.connShard(b.conn.index)
+	shard.Lock()
+	if e, ok := shard.m[b.conn.index]; ok && e.id == id && e.gen == gen {
+		e.id = ""
+		e.gen = 0
+	}
+	r.unbindLocked(id, gen)
+	shard.Unlock()
+}
+
+// unbindLocked must be called with the conn shard of the binding locked
+func (r *Registry) unbindLocked(id string, gen uint64) {
+	ids := r.idShard(id)
+	ids.Lock()
+	if ids.m[id].gen == gen {
+		delete(ids.m, id)
+	}
+	ids.Unlock()
+}
+
+// Get returns the conn registered under index, nil if there is none
+func (r *Registry) Get(index uint64) *Conn {
+	shard := r.connShard(index)
+	shard.RLock()
+	defer shard.RUnlock()
+
+	if e, ok := shard.m[index]; ok {
+		return e.conn
+	}
+
+	return nil
+}
+
+// idOf returns the device ID bound to c, "" if none
+func (r *Registry) idOf(c *Conn) string {
+	shard := r.connShard(c.index)
+	shard.RLock()
+	defer shard.RUnlock()
+
+	if e, ok := shard.m[c.index]; ok && e.conn == c {
+		return e.id
+	}
+
+	return ""
+}
+
+// GetByID returns the conn the device ID id is bound to, nil if there is none
+func (r *Registry) GetByID(id string) *Conn {
+	c, _ := r.Lookup(id)
+	return c
+}
+
+// Lookup returns the conn the device ID id is bound to and the generation
+// of the binding, nil and 0 if there is none
+func (r *Registry) Lookup(id string) (*Conn, uint64) {
+	ids := r.idShard(id)
+	ids.RLock()
+	defer ids.RUnlock()
+
+	b := ids.m[id]
+	return b.conn, b.gen
+}
+
+// Range calls f for every registered conn until f returns false,
+// f must not add or remove conns
+func (r *Registry) Range(f func(*Conn) bool) {
+	for i := range r.conns {
+		shard := &r.conns[i]
+		shard.RLock()
+		for _, e := range shard.m {
+			if !f(e.conn) {
+				shard.RUnlock()
+				return
+			}
+		}
+		shard.RUnlock()
+	}
+}
+
+// Count returns the number of registered conns
+func (r *Registry) Count() int {
+	return int(atomic.LoadInt64(&r.count))
+}
+
+// Snapshot returns the registered conns at the time of the call
+func (r *Registry) Snapshot() []*Conn {
+	conns := make([]*Conn, 0, r.Count())
+	r.Range(func(c *Conn) bool {
+		conns = append(conns, c)
+		return true
+	})
+
+	return conns
+}
@@ -0,0 +1,84 @@
+package gotcp
+
+import (
+	"testing"
+)
+
+func registered(r *Registry) *Conn {
+	c := &Conn{index: r.NextIndex()}
+	r.Add(c)
+	return c
+}
+
+func TestRegistryTakeOver(t *testing.T) {
+	r := NewRegistry()
+	a, b := registered(r), registered(r)
+	if a.index == b.index {
+		t.Fatalf("index %d handed out twice", a.index)
+	}
+
+	old, gen1, err := r.Bind("BED", a, false)
+	if err != nil || old != nil {
+		t.Fatalf("bind: %v %v", old, err)
+	}
+
+	if old, _, err = r.Bind("BED", b, false); err != ErrDuplicateLogin || old != a {
+		t.Fatalf("bind without replace: %v %v", old, err)
+	}
+	if c, gen := r.Lookup("BED"); c != a || gen != gen1 {
+		t.Fatalf("rejected bind changed the binding to %v %d", c, gen)
+	}
+
+	old, gen2, err := r.Bind("BED", b, true)
+	if err != nil || old != a || gen2 <= gen1 {
+		t.Fatalf("replace: %v %d %v", old, gen2, err)
+	}
+
+	// the stale conn and the stale generation leave the new binding alone
+	r.Remove(a)
+	r.Unbind("BED", gen1)
+	if c, gen := r.Lookup("BED"); c != b || gen != gen2 {
+		t.Fatalf("stale removal changed the binding to %v %d", c, gen)
+	}
+	if r.Count() != 1 {
+		t.Fatalf("%d conns", r.Count())
+	}
+
+	r.Unbind("BED", gen2)
+	if c := r.GetByID("BED"); c != nil || r.idOf(b) != "" {
+		t.Fatalf("still bound to %v as %q", c, r.idOf(b))
+	}
+	if r.Get(b.index) != b {
+		t.Fatal("unbind removed the conn")
+	}
+}
+
+func TestRegistryRebind(t *testing.T) {
+	r := NewRegistry()
+	c := registered(r)
+
+	var bound []string
+	r.OnBind(func(id string, bc *Conn) {
+		if bc == c {
+			bound = append(bound, id)
+		}
+	})
+
+	r.Bind("OLD", c, false)
+	r.Bind("NEW", c, false)
+	if r.GetByID("OLD") != nil || r.GetByID("NEW") != c || r.idOf(c) != "NEW" {
+		t.Fatalf("OLD %v NEW %v ID %q", r.GetByID("OLD"), r.GetByID("NEW"), r.idOf(c))
+	}
+	if len(bound) != 2 || bound[0] != "OLD" || bound[1] != "NEW" {
+		t.Fatalf("OnBind called with %q", bound)
+	}
+
+	r.Remove(c)
+	if r.GetByID("NEW") != nil || r.Get(c.index) != nil || r.Count() != 0 {
+		t.Fatal("removed conn still registered")
+	}
+
+	if _, _, err := r.Bind("NEW", c, true); err != ErrConnNotFound {
+		t.Fatalf("bind of a removed conn: %v", err)
+	}
+}
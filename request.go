@@ -0,0 +1,190 @@
+package gotcp
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const defaultMaxInflightRequests = 256
+
+var (
+	ErrRequestTimeout   = errors.New("request timeout")
+	ErrRequestCanceled  = errors.New("request canceled")
+	ErrTooManyRequests  = errors.New("too many requests in flight")
+	ErrDuplicateRequest = errors.New("request with the same correlation key in flight")
+	ErrNoCorrelationKey = errors.New("packet has no correlation key")
+)
+
+// CorrelatedPacket is an optional interface of Packet, CorrelationKey
+// returns the key tying a response to its request, such as a serial id.
+// It is used when Config.CorrelationKey is nil.
+type CorrelatedPacket interface {
+	CorrelationKey() (interface{}, bool)
+}
+
+// correlationKey returns the correlation key of p
+func (s *Server) correlationKey(p Packet) (interface{}, bool) {
+	if s.config.CorrelationKey != nil {
+		return s.config.CorrelationKey(p)
+	}
+
+	if cp, ok := p.(CorrelatedPacket); ok {
+		return cp.CorrelationKey()
+	}
+
+	return nil, false
+}
+
+// Future is the pending response of a request
+type Future struct {
+	conn  *Conn
+	key   interface{}
+	timer *time.Timer // guarded by the requestLock of conn
+	once  sync.Once
+	done  chan struct{}
+	resp  Packet
+	at    time.Time // when resp was read
+	err   error
+}
+
+// Done is closed when the response arrived or the request failed
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the response arrives or the request fails
+func (f *Future) Wait() (Packet, error) {
+	<-f.done
+	return f.resp, f.err
+}
+
+// ReceivedAt returns when the response was read, zero if the request
+// failed, only meaningful once Done is closed
+func (f *Future) ReceivedAt() time.Time {
+	return f.at
+}
+
+// Cancel fails the request with ErrRequestCanceled, a late response is
+// then passed to OnMessage
+func (f *Future) Cancel() {
+	f.complete(nil, ErrRequestCanceled)
+}
+
+func (f *Future) complete(resp Packet, err error) {
+	f.once.Do(func() {
+		f.conn.requestLock.Lock()
+		if f.conn.requests[f.key] == f {
+			delete(f.conn.requests, f.key)
+		}
+		if f.timer != nil {
+			f.timer.Stop()
+		}
+		f.conn.requestLock.Unlock()
+
+		f.resp, f.err = resp, err
+		if resp != nil {
+			// responses are completed by the handleLoop of conn, while they are handled
+			f.at = f.conn.ReceivedAt()
+		}
+		close(f.done)
+	})
+}
+
+// Request writes p with PriorityBroker and blocks until the inbound
+// packet with the same correlation key arrives, or timeout expires
+func (c *Conn) Request(p Packet, timeout time.Duration) (Packet, error) {
+	f, err := c.RequestAsync(p, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.Wait()
+}
+
+// RequestAsync writes p with PriorityBroker and returns the Future of the
+// inbound packet with the same correlation key. The response is not passed
+// to OnMessage. The future fails with ErrRequestTimeout once timeout
+// expires, 0 means never, and with ErrConnClosing when the conn closes.
+// p waits for room in the queue up to timeout, for ever if 0.
+func (c *Conn) RequestAsync(p Packet, timeout time.Duration) (*Future, error) {
+	key, ok := c.srv.correlationKey(p)
+	if !ok {
+		return nil, ErrNoCorrelationKey
+	}
+
+	limit := c.srv.config.MaxInflightRequests
+	if limit <= 0 {
+		limit = defaultMaxInflightRequests
+	}
+
+	f := &Future{conn: c, key: key, done: make(chan struct{})}
+
+	c.requestLock.Lock()
+	if c.IsClosed() {
+		c.requestLock.Unlock()
+		return nil, ErrConnClosing
+	}
+	if len(c.requests) >= limit {
+		c.requestLock.Unlock()
+		return nil, ErrTooManyRequests
+	}
+	if _, ok := c.requests[key]; ok {
+		c.requestLock.Unlock()
+		return nil, ErrDuplicateRequest
+	}
+	if c.requests == nil {
+		c.requests = make(map[interface{}]*Future)
+	}
+	c.requests[key] = f
+	if timeout > 0 {
+		f.timer = time.AfterFunc(timeout, func() {
+			f.complete(nil, ErrRequestTimeout)
+		})
+	}
+	c.requestLock.Unlock()
+
+	// a request that never expires waits for room in the queue as long as it takes
+	writeTimeout := timeout
+	if writeTimeout <= 0 {
+		writeTimeout = -1
+	}
+	if err := c.WritePacket(p, PriorityBroker, writeTimeout); err != nil {
+		f.complete(nil, err)
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// completeRequest hands p to the request waiting for it, if any
+func (c *Conn) completeRequest(p Packet) bool {
+	key, ok := c.srv.correlationKey(p)
+	if !ok {
+		return false
+	}
+
+	c.requestLock.Lock()
+	f, ok := c.requests[key]
+	c.requestLock.Unlock()
+	if !ok {
+		return false
+	}
+
+	f.complete(p, nil)
+	return true
+}
+
+// failRequests fails every pending request with err
+func (c *Conn) failRequests(err error) {
+	c.requestLock.Lock()
+	futures := make([]*Future, 0, len(c.requests))
+	for _, f := range c.requests {
+		futures = append(futures, f)
+	}
+	c.requestLock.Unlock()
+
+	for _, f := range futures {
+		f.complete(nil, err)
+	}
+}
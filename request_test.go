@@ -0,0 +1,223 @@
+package gotcp
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// messageCallback reports the packets passed to OnMessage
+type messageCallback struct {
+	lineCallback
+	messages chan *linePacket
+}
+
+func (cb messageCallback) OnMessage(c *Conn, p Packet) bool {
+	if lp := p.(*linePacket); lp.kind != "LOGIN" {
+		cb.messages <- lp
+	}
+	return cb.lineCallback.OnMessage(c, p)
+}
+
+// requestDevice logs in as id and returns the lines it reads once read is
+// called, and the conn the server bound to id
+func requestDevice(t *testing.T, srv *Server, l *pipeListener, id string) (net.Conn, *Conn, chan<- bool, <-chan string) {
+	conn := l.Dial()
+	t.Cleanup(func() { conn.Close() })
+
+	read := make(chan bool, 1)
+	lines := make(chan string, 16)
+	go func() {
+		conn.Write([]byte("LOGIN " + id + "\n"))
+		<-read
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if c := srv.Registry().GetByID(id); c != nil {
+			return conn, c, read, lines
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s not bound", id)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func startRequestServer(t *testing.T, config *Config) (*Server, *pipeListener, chan *linePacket) {
+	messages := make(chan *linePacket, 16)
+	srv, l := startPipeServer(t, config, messageCallback{messages: messages}, nil)
+	return srv, l, messages
+}
+
+func TestRequestResponse(t *testing.T) {
+	srv, l, messages := startRequestServer(t, &Config{})
+	conn, c, read, lines := requestDevice(t, srv, l, "BED")
+	read <- true
+
+	f, err := c.RequestAsync(&linePacket{kind: "CMD", arg: "1"}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line := receive(t, lines, "request"); line != "CMD 1" {
+		t.Fatalf("device read %q", line)
+	}
+	conn.Write([]byte("ACK 1\n"))
+
+	resp, err := f.Wait()
+	if err != nil || resp.(*linePacket).kind != "ACK" || f.ReceivedAt().IsZero() {
+		t.Fatalf("response %v %v at %v", resp, err, f.ReceivedAt())
+	}
+
+	// the response went to the request, not to OnMessage
+	conn.Write([]byte("PING 2\n"))
+	if m := <-messages; m.kind != "PING" {
+		t.Fatalf("OnMessage got %v", m)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	srv, l, messages := startRequestServer(t, &Config{})
+	conn, c, read, _ := requestDevice(t, srv, l, "BED")
+	read <- true
+
+	if _, err := c.Request(&linePacket{kind: "CMD", arg: "1"}, 10*time.Millisecond); err != ErrRequestTimeout {
+		t.Fatalf("unanswered request: %v", err)
+	}
+
+	// the key is free again, the late response is a plain message
+	conn.Write([]byte("ACK 1\n"))
+	if m := <-messages; m.kind != "ACK" || m.arg != "1" {
+		t.Fatalf("OnMessage got %v", m)
+	}
+	f, err := c.RequestAsync(&linePacket{kind: "CMD", arg: "1"}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Cancel()
+}
+
+func TestRequestCancel(t *testing.T) {
+	srv, l, messages := startRequestServer(t, &Config{})
+	conn, c, read, _ := requestDevice(t, srv, l, "BED")
+	read <- true
+
+	f, err := c.RequestAsync(&linePacket{kind: "CMD", arg: "1"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Cancel()
+	if _, err := f.Wait(); err != ErrRequestCanceled {
+		t.Fatalf("canceled request: %v", err)
+	}
+
+	conn.Write([]byte("ACK 1\n"))
+	select {
+	case m := <-messages:
+		if m.kind != "ACK" {
+			t.Fatalf("OnMessage got %v", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("late response not passed to OnMessage")
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	srv, l, _ := startRequestServer(t, &Config{MaxInflightRequests: 2})
+	_, c, read, _ := requestDevice(t, srv, l, "BED")
+	read <- true
+
+	first, err := c.RequestAsync(&linePacket{kind: "CMD", arg: "1"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.RequestAsync(&linePacket{kind: "CMD", arg: "1"}, 0); err != ErrDuplicateRequest {
+		t.Fatalf("same key twice: %v", err)
+	}
+	if _, err := c.RequestAsync(&linePacket{kind: "CMD", arg: "2"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.RequestAsync(&linePacket{kind: "CMD", arg: "3"}, 0); err != ErrTooManyRequests {
+		t.Fatalf("request over the limit: %v", err)
+	}
+
+	first.Cancel()
+	if _, err := c.RequestAsync(&linePacket{kind: "CMD", arg: "3"}, 0); err != nil {
+		t.Fatalf("request after a cancel: %v", err)
+	}
+	if _, err := c.RequestAsync(&linePacket{kind: "PING", arg: "4"}, 0); err != ErrNoCorrelationKey {
+		t.Fatalf("uncorrelated request: %v", err)
+	}
+}
+
+func TestRequestClose(t *testing.T) {
+	srv, l, _ := startRequestServer(t, &Config{})
+	conn, c, read, _ := requestDevice(t, srv, l, "BED")
+	read <- true
+
+	f, err := c.RequestAsync(&linePacket{kind: "CMD", arg: "1"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	select {
+	case <-f.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("request pending after close")
+	}
+	if _, err := f.Wait(); err != ErrConnClosing {
+		t.Fatalf("request of a closed conn: %v", err)
+	}
+	if _, err := c.RequestAsync(&linePacket{kind: "CMD", arg: "2"}, 0); err != ErrConnClosing {
+		t.Fatalf("request on a closed conn: %v", err)
+	}
+}
+
+// TestRequestWaitsForRoom checks a request that never expires waits for a
+// full queue instead of failing with ErrWriteBlocking
+func TestRequestWaitsForRoom(t *testing.T) {
+	srv, l, _ := startRequestServer(t, &Config{PacketSendChanLimit: 1})
+	_, c, read, lines := requestDevice(t, srv, l, "BED")
+
+	// the device does not read yet, the writer blocks on the packets it
+	// took and the queue fills up behind it
+	lane := c.packetSendChans[PriorityBroker]
+	var expected []string
+	deadline := time.Now().Add(2 * time.Second)
+	for len(lane) < cap(lane) || len(expected) < 2 {
+		arg := strconv.Itoa(len(expected) + 1)
+		if c.NsqWritePacket(&linePacket{kind: "BULK", arg: arg}, 0) == nil {
+			expected = append(expected, "BULK "+arg)
+		} else if time.Now().After(deadline) {
+			t.Fatal("queue never had room")
+		}
+		time.Sleep(5 * time.Millisecond) // lets the writer take what it can
+	}
+
+	queued := make(chan error, 1)
+	go func() {
+		_, err := c.RequestAsync(&linePacket{kind: "CMD", arg: "0"}, 0)
+		queued <- err
+	}()
+	select {
+	case err := <-queued:
+		t.Fatalf("request into a full queue returned %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	read <- true
+	if err := <-queued; err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range append(expected, "CMD 0") {
+		if got := receive(t, lines, line); got != line {
+			t.Fatalf("device read %q, expected %q", got, line)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package gotcp
+
+import (
+	"sync"
+)
+
+// KeyedPacket is an optional interface of Packet, PacketKey returns the
+// key a Router dispatches the packet by, such as its command type
+type KeyedPacket interface {
+	PacketKey() interface{}
+}
+
+// HandlerFunc handles the packets routed to it,
+// If the return value of false is closed
+type HandlerFunc func(*Conn, Packet) bool
+
+// Middleware wraps a HandlerFunc, to log, authorize or measure packets
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Router is a ConnCallback dispatching packets to the handler registered
+// for their key. OnConnect accepts every conn and OnClose does nothing,
+// embed the Router to override them. Routes must be registered before
+// the server starts.
+type Router struct {
+	routes     map[interface{}]HandlerFunc
+	fallback   HandlerFunc
+	middleware []Middleware
+
+	unhandledLock sync.Mutex
+	unhandled     map[interface{}]uint64 // packets without a route, by key
+}
+
+// NewRouter creates a router without routes
+func NewRouter() *Router {
+	return &Router{
+		routes:    make(map[interface{}]HandlerFunc),
+		unhandled: make(map[interface{}]uint64),
+	}
+}
+
+// Handle registers h for the packets of key, wrapped by middleware
+func (r *Router) Handle(key interface{}, h HandlerFunc, middleware ...Middleware) {
+	r.routes[key] = chain(h, middleware)
+}
+
+// Fallback registers h for the packets without a route,
+// without a fallback they are dropped
+func (r *Router) Fallback(h HandlerFunc, middleware ...Middleware) {
+	r.fallback = chain(h, middleware)
+}
+
+// Use adds middleware wrapping every route and the fallback
+func (r *Router) Use(middleware ...Middleware) {
+	r.middleware = append(r.middleware, middleware...)
+}
+
+// Unhandled returns the number of packets without a route, by key
+func (r *Router) Unhandled() map[interface{}]uint64 {
+	r.unhandledLock.Lock()
+	defer r.unhandledLock.Unlock()
+
+	unhandled := make(map[interface{}]uint64, len(r.unhandled))
+	for key, n := range r.unhandled {
+		unhandled[key] = n
+	}
+
+	return unhandled
+}
+
+// chain wraps h with middleware, the first one being the outermost
+func chain(h HandlerFunc, middleware []Middleware) HandlerFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+
+	return h
+}
+
+func (r *Router) OnConnect(*Conn) bool {
+	return true
+}
+
+func (r *Router) OnMessage(c *Conn, p Packet) bool {
+	var key interface{}
+	if kp, ok := p.(KeyedPacket); ok {
+		key = kp.PacketKey()
+	}
+
+	h, ok := r.routes[key]
+	if !ok {
+		r.unhandledLock.Lock()
+		r.unhandled[key]++
+		r.unhandledLock.Unlock()
+
+		if h = r.fallback; h == nil {
+			return true
+		}
+	}
+
+	return chain(h, r.middleware)(c, p)
+}
+
+func (r *Router) OnClose(*Conn) {
+}
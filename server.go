@@ -1,6 +1,9 @@
 package gotcp
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"net"
 	"sync"
 	"time"
@@ -9,39 +12,148 @@ import (
 type Config struct {
 	PacketSendChanLimit    uint32 // the limit of packet send channel
 	PacketReceiveChanLimit uint32 // the limit of packet receive channel
+	MaxFrameSize           int    // the limit the read buffer grows to, 0 means 64KB
+
+	TLSConfig        *tls.Config                         // serve TLS when set, see NewTLSConfig
+	HandshakeTimeout time.Duration                       // the limit of the TLS handshake, 0 means 10s
+	PeerIdentity     func(cert *x509.Certificate) string // derive the identity from a verified client certificate, CertIdentity if nil
+
+	DuplicateLogin DuplicateLoginPolicy // what SetID does when the device ID is bound to another live conn
+
+	ReadIdleTimeout  time.Duration // the limit of time without reading a packet, 0 means no limit
+	WriteIdleTimeout time.Duration // the limit of time without writing a packet, 0 means no limit
+	IdleTimeout      time.Duration // the limit of time without reading or writing, 0 means no limit
+
+	WriteBatchSize    int           // the max packets coalesced into one write, 0 means 64
+	WriteFlushLatency time.Duration // how long the writer waits for more packets before writing, 0 means no wait
+
+	CorrelationKey      func(Packet) (interface{}, bool) // ties responses to Conn.Request, CorrelatedPacket if nil
+	MaxInflightRequests int                              // the limit of pending requests per conn, 0 means 256
+
+	PresenceTopic string // where the presence events are published through the mqhub as JSON or protobuf envelopes, none if ""
+}
+
+// DuplicateLoginPolicy decides what happens when a device ID that is
+// bound to a live conn is bound to another one
+type DuplicateLoginPolicy int
+
+const (
+	// DuplicateKickOld binds the new conn and closes the old one with ErrLoginTakenOver
+	DuplicateKickOld DuplicateLoginPolicy = iota
+	// DuplicateRejectNew keeps the old binding, SetID returns ErrDuplicateLogin
+	DuplicateRejectNew
+	// DuplicateAllow binds the new conn and keeps the old one open
+	DuplicateAllow
+)
+
+func (p DuplicateLoginPolicy) String() string {
+	switch p {
+	case DuplicateKickOld:
+		return "kick old"
+	case DuplicateRejectNew:
+		return "reject new"
+	case DuplicateAllow:
+		return "allow"
+	}
+
+	return "unknown"
+}
+
+// DuplicateLogin describes a device ID bound while it was bound to another conn
+type DuplicateLogin struct {
+	ID     string
+	Old    *Conn // the conn id was bound to
+	New    *Conn // the conn that asked for id
+	Policy DuplicateLoginPolicy
+}
+
+// DuplicateLoginCallback is an optional interface of ConnCallback,
+// OnDuplicateLogin is called after the policy has been applied
+type DuplicateLoginCallback interface {
+	OnDuplicateLogin(*DuplicateLogin)
 }
 
 type Server struct {
 	config    *Config         // server configuration
 	callback  ConnCallback    // message callbacks in connection
 	protocol  Protocol        // customize packet protocol
+	pipeline  *Pipeline       // handlers between protocol and callback
 	exitChan  chan struct{}   // notify all goroutines to shutdown
+	exitOnce  sync.Once       // close exitChan, once
 	waitGroup *sync.WaitGroup // wait for all goroutines
 	mqhub     *Mqhub
+	registry  *Registry    // live connections, shared with mqhub
+	wheel     *timingWheel // drives the idle timeouts, nil if there are none
+
+	writeStats writeCounters // counters of all the writers
+
+	listenerLock sync.Mutex
+	listener     net.Listener // the listener passed to Start
 }
 
-// NewServer creates a server
+// NewServer creates a server, mqhub may be nil
 func NewServer(config *Config, callback ConnCallback, protocol Protocol, mqhub *Mqhub) *Server {
-	return &Server{
+	s := &Server{
 		config:    config,
 		callback:  callback,
 		protocol:  protocol,
+		pipeline:  &Pipeline{},
 		exitChan:  make(chan struct{}),
 		waitGroup: &sync.WaitGroup{},
 		mqhub:     mqhub,
 	}
+
+	if mqhub != nil {
+		s.registry = mqhub.Registry()
+	} else {
+		s.registry = NewRegistry()
+	}
+
+	if tick := idleTick(config); tick > 0 {
+		s.wheel = newTimingWheel(tick, 512)
+	}
+
+	return s
+}
+
+// Pipeline returns the handler pipeline, handlers must be added before Start
+func (s *Server) Pipeline() *Pipeline {
+	return s.pipeline
 }
 
-// Start starts service
-func (s *Server) Start(listener *net.TCPListener, acceptTimeout time.Duration) {
+// Registry returns the registry of the live connections
+func (s *Server) Registry() *Registry {
+	return s.registry
+}
+
+// deadlineListener is implemented by listeners that support accept deadlines,
+// such as *net.TCPListener and *net.UnixListener
+type deadlineListener interface {
+	SetDeadline(t time.Time) error
+}
+
+// WriteStats returns the write counters summed over all the connections
+func (s *Server) WriteStats() WriteStats {
+	return s.writeStats.load()
+}
+
+// Start starts service, acceptTimeout is only applied to listeners
+// that support accept deadlines
+func (s *Server) Start(listener net.Listener, acceptTimeout time.Duration) {
 	s.waitGroup.Add(1)
 	defer func() {
 		listener.Close()
 		s.waitGroup.Done()
 	}()
 
-	var index uint32
-	index = 0
+	s.listenerLock.Lock()
+	s.listener = listener
+	s.listenerLock.Unlock()
+
+	if s.wheel != nil {
+		s.wheel.start()
+	}
+
 	for {
 		select {
 		case <-s.exitChan:
@@ -50,23 +162,70 @@ func (s *Server) Start(listener *net.TCPListener, acceptTimeout time.Duration) {
 		default:
 		}
 
-		listener.SetDeadline(time.Now().Add(acceptTimeout))
+		if l, ok := listener.(deadlineListener); ok {
+			l.SetDeadline(time.Now().Add(acceptTimeout))
+		}
 
-		conn, err := listener.AcceptTCP()
+		conn, err := listener.Accept()
 		if err != nil {
 			continue
 		}
 
-		myconn := newConn(conn, s, index)
-		s.mqhub.conns[index] = myconn
-		index += 1
+		if s.config.TLSConfig != nil {
+			conn = tls.Server(conn, s.config.TLSConfig)
+		}
+
+		myconn := newConn(conn, s, s.registry.NextIndex())
+		s.registry.Add(myconn)
 
-		go myconn.Do()
+		s.waitGroup.Add(1)
+		go func() {
+			defer s.waitGroup.Done()
+			myconn.Do()
+		}()
 	}
 }
 
-// Stop stops service
+// Stop stops service, it waits until every connection has flushed its
+// queued packets and closed
 func (s *Server) Stop() {
-	close(s.exitChan)
-	s.waitGroup.Wait()
+	s.Shutdown(context.Background())
+}
+
+// Shutdown stops accepting new connections and lets every connection flush
+// its queued packets before closing it with ErrServerShutdown. If ctx
+// expires first the remaining connections are closed at once and ctx.Err()
+// is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.exitOnce.Do(func() {
+		close(s.exitChan)
+	})
+
+	s.listenerLock.Lock()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.listenerLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.waitGroup.Wait()
+		close(done)
+	}()
+
+	if s.wheel != nil {
+		defer s.wheel.stop()
+	}
+
+	select {
+	case <-done:
+		return nil
+
+	case <-ctx.Done():
+		for _, c := range s.registry.Snapshot() {
+			c.close(CloseReason{Kind: CloseShutdown, Err: ErrServerShutdown})
+		}
+
+		return ctx.Err()
+	}
 }
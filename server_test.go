@@ -0,0 +1,61 @@
+package gotcp
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestShutdownFlushes(t *testing.T) {
+	srv, l, _ := startRequestServer(t, &Config{})
+	_, c, read, lines := requestDevice(t, srv, l, "BED")
+
+	// queued while the device does not read
+	for i := 0; i < 5; i++ {
+		if err := c.AsyncWritePacket(&linePacket{kind: "PING", arg: strconv.Itoa(i)}, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		shutdown <- srv.Shutdown(ctx)
+	}()
+
+	read <- true
+	for i := 0; i < 5; i++ {
+		if line := receive(t, lines, "queued packet"); line != "PING "+strconv.Itoa(i) {
+			t.Fatalf("device read %q, expected packet %d", line, i)
+		}
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if reason := c.CloseReason(); reason.Kind != CloseShutdown || c.CloseError() != ErrServerShutdown {
+		t.Fatalf("closed with %v", reason)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	srv, l, _ := startRequestServer(t, &Config{})
+	_, c, _, _ := requestDevice(t, srv, l, "BED")
+
+	// the device never reads, the writer can not flush
+	c.AsyncWritePacket(&linePacket{kind: "PING", arg: "0"}, time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("shutdown took %v", elapsed)
+	}
+	if !c.IsClosed() || c.CloseReason().Kind != CloseShutdown {
+		t.Fatalf("conn closed %v with %v", c.IsClosed(), c.CloseReason())
+	}
+}
@@ -0,0 +1,495 @@
+package gotcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	spoolFileExt       = ".spool"
+	spoolCursorFile    = "cursor"
+	spoolHeaderSize    = 18 // length(4) + crc(4) + unix nano(8) + topic length(2)
+	defaultSegmentSize = 4 << 20
+	defaultMinBackoff  = 100 * time.Millisecond
+	defaultMaxBackoff  = 30 * time.Second
+)
+
+var (
+	ErrSpoolClosed  = errors.New("spool closed")
+	errSpoolCorrupt = errors.New("spool record corrupt")
+)
+
+type SpoolConfig struct {
+	Dir         string        // where the segment files are kept
+	SegmentSize int64         // a segment is rotated once it is that large, 4MB if 0
+	MinBackoff  time.Duration // the first retry delay of a failed replay, 100ms if 0
+	MaxBackoff  time.Duration // the longest retry delay, 30s if 0
+}
+
+// SpoolStats is a snapshot of the messages waiting in a spool
+type SpoolStats struct {
+	Depth    int           // the messages not replayed yet
+	Bytes    int64         // their size on disk
+	Segments int           // the segment files holding them
+	Age      time.Duration // how long the oldest one has been waiting
+}
+
+// Spool keeps the messages that failed to publish in segment files, each
+// record checksummed, and replays them in order in the background
+type Spool struct {
+	config  SpoolConfig
+	publish func(topic string, body []byte) error
+
+	lock     sync.Mutex
+	segments []*spoolSegment // oldest first, the last one is written to
+	w        *os.File        // the file of the last segment, nil until appended to
+	r        *os.File        // the file of the first segment, nil until replayed
+	rOff     int64           // the offset of the next record to replay in r
+	depth    int
+	bytes    int64
+	oldest   time.Time // the time the next record to replay was spooled
+	closed   bool
+	notify   chan struct{}
+	exitChan chan struct{}
+	done     chan struct{}
+}
+
+type spoolSegment struct {
+	id      uint64
+	size    int64 // the bytes written
+	records int   // the records not replayed yet
+	bytes   int64 // their size
+}
+
+type spoolRecord struct {
+	topic string
+	body  []byte
+	time  time.Time
+	size  int64
+}
+
+// OpenSpool opens the spool in config.Dir, the messages left by a previous
+// run are replayed first. Messages are replayed with publish, retried with
+// an exponential backoff until it succeeds.
+func OpenSpool(config *SpoolConfig, publish func(topic string, body []byte) error) (*Spool, error) {
+	s := &Spool{
+		config:   *config,
+		publish:  publish,
+		notify:   make(chan struct{}, 1),
+		exitChan: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if s.config.SegmentSize <= 0 {
+		s.config.SegmentSize = defaultSegmentSize
+	}
+	if s.config.MinBackoff <= 0 {
+		s.config.MinBackoff = defaultMinBackoff
+	}
+	if s.config.MaxBackoff < s.config.MinBackoff {
+		s.config.MaxBackoff = defaultMaxBackoff
+	}
+
+	if err := os.MkdirAll(s.config.Dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	go s.replayLoop()
+
+	return s, nil
+}
+
+func (s *Spool) segmentPath(id uint64) string {
+	return filepath.Join(s.config.Dir, fmt.Sprintf("%020d%s", id, spoolFileExt))
+}
+
+// load scans the segments left from the cursor, appends then go to a new segment
+func (s *Spool) load() error {
+	names, err := filepath.Glob(filepath.Join(s.config.Dir, "*"+spoolFileExt))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	cursorID, cursorOff := s.readCursor()
+	var lastID uint64
+	for _, name := range names {
+		var id uint64
+		if _, err := fmt.Sscanf(filepath.Base(name), "%d"+spoolFileExt, &id); err != nil {
+			continue
+		}
+		lastID = id
+		if id < cursorID {
+			os.Remove(name)
+			continue
+		}
+
+		off := int64(0)
+		if id == cursorID {
+			off = cursorOff
+		}
+		seg, oldest, err := scanSegment(name, id, off)
+		if err != nil {
+			return err
+		}
+		if s.depth == 0 && seg.records > 0 {
+			s.oldest = oldest
+		}
+		if len(s.segments) == 0 {
+			s.rOff = off
+		}
+		s.segments = append(s.segments, seg)
+		s.depth += seg.records
+		s.bytes += seg.bytes
+	}
+
+	// the cursor may point past the segments if they were all replayed
+	if lastID < cursorID {
+		lastID = cursorID
+	}
+	s.segments = append(s.segments, &spoolSegment{id: lastID + 1})
+	if len(s.segments) == 1 {
+		s.rOff = 0
+	}
+
+	return nil
+}
+
+// scanSegment counts the valid records of a segment from off
+func scanSegment(name string, id uint64, off int64) (*spoolSegment, time.Time, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+
+	seg := &spoolSegment{id: id}
+	var oldest time.Time
+	for {
+		rec, err := readRecord(f, off)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("spool segment %d corrupt at %d: %v", id, off, err)
+			}
+			break
+		}
+		if seg.records == 0 {
+			oldest = rec.time
+		}
+		seg.records++
+		seg.bytes += rec.size
+		off += rec.size
+	}
+	seg.size = off
+
+	return seg, oldest, nil
+}
+
+func (s *Spool) readCursor() (uint64, int64) {
+	b, err := os.ReadFile(filepath.Join(s.config.Dir, spoolCursorFile))
+	if err != nil || len(b) != 16 {
+		return 0, 0
+	}
+
+	return binary.BigEndian.Uint64(b), int64(binary.BigEndian.Uint64(b[8:]))
+}
+
+// writeCursor records the position of the next record to replay
+func (s *Spool) writeCursor() {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:], s.segments[0].id)
+	binary.BigEndian.PutUint64(b[8:], uint64(s.rOff))
+
+	name := filepath.Join(s.config.Dir, spoolCursorFile)
+	if err := os.WriteFile(name+".tmp", b[:], 0644); err == nil {
+		os.Rename(name+".tmp", name)
+	}
+}
+
+// readRecord reads the record at off, io.EOF if there is no whole record
+func readRecord(f *os.File, off int64) (*spoolRecord, error) {
+	var header [spoolHeaderSize]byte
+	if n, err := f.ReadAt(header[:], off); n < len(header) {
+		if err == nil || err == io.EOF {
+			err = io.EOF
+		}
+		return nil, err
+	}
+
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	topicLen := int64(binary.BigEndian.Uint16(header[16:18]))
+	if length < spoolHeaderSize+topicLen {
+		return nil, errSpoolCorrupt
+	}
+
+	data := make([]byte, length-8)
+	if n, err := f.ReadAt(data, off+8); int64(n) < int64(len(data)) {
+		if err == nil || err == io.EOF {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errSpoolCorrupt
+	}
+
+	return &spoolRecord{
+		time:  time.Unix(0, int64(binary.BigEndian.Uint64(data[0:8]))),
+		topic: string(data[10 : 10+topicLen]),
+		body:  data[10+topicLen:],
+		size:  length,
+	}, nil
+}
+
+func appendRecord(buf []byte, topic string, body []byte, now time.Time) []byte {
+	var header [spoolHeaderSize]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(spoolHeaderSize+len(topic)+len(body)))
+	binary.BigEndian.PutUint64(header[8:16], uint64(now.UnixNano()))
+	binary.BigEndian.PutUint16(header[16:18], uint16(len(topic)))
+
+	start := len(buf)
+	buf = append(buf, header[:]...)
+	buf = append(buf, topic...)
+	buf = append(buf, body...)
+	binary.BigEndian.PutUint32(buf[start+4:start+8], crc32.ChecksumIEEE(buf[start+8:]))
+
+	return buf
+}
+
+// Publish publishes body directly while nothing is spooled, so the order
+// is kept, and spools it if that fails
+func (s *Spool) Publish(topic string, body []byte) error {
+	s.lock.Lock()
+	pending := s.depth > 0
+	s.lock.Unlock()
+
+	if !pending && s.publish(topic, body) == nil {
+		return nil
+	}
+
+	return s.Append(topic, body)
+}
+
+// Append spools body to be published to topic
+func (s *Spool) Append(topic string, body []byte) error {
+	if len(topic) > 0xFFFF {
+		return fmt.Errorf("spool topic too long: %d bytes", len(topic))
+	}
+
+	now := time.Now()
+	record := appendRecord(nil, topic, body, now)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return ErrSpoolClosed
+	}
+
+	seg := s.segments[len(s.segments)-1]
+	if s.w != nil && seg.size+int64(len(record)) > s.config.SegmentSize && seg.size > 0 {
+		s.w.Close()
+		s.w = nil
+		seg = &spoolSegment{id: seg.id + 1}
+		s.segments = append(s.segments, seg)
+	}
+	if s.w == nil {
+		f, err := os.OpenFile(s.segmentPath(seg.id), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		s.w = f
+	}
+
+	_, err := s.w.Write(record)
+	if err == nil {
+		err = s.w.Sync()
+	}
+	if err != nil {
+		// cut the partial record, the next ones would be appended after it
+		if s.w.Truncate(seg.size) != nil {
+			s.w.Close()
+			s.w = nil
+			s.segments = append(s.segments, &spoolSegment{id: seg.id + 1})
+		}
+		return err
+	}
+
+	seg.size += int64(len(record))
+	seg.records++
+	seg.bytes += int64(len(record))
+	if s.depth == 0 {
+		s.oldest = now
+	}
+	s.depth++
+	s.bytes += int64(len(record))
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Stats returns the depth and age of the spool
+func (s *Spool) Stats() SpoolStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stats := SpoolStats{
+		Depth:    s.depth,
+		Bytes:    s.bytes,
+		Segments: len(s.segments),
+	}
+	if s.depth > 0 && !s.oldest.IsZero() {
+		stats.Age = time.Since(s.oldest)
+	}
+
+	return stats
+}
+
+// next returns the next record to replay, io.EOF if there is none
+func (s *Spool) next() (*spoolRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for {
+		seg := s.segments[0]
+		active := len(s.segments) == 1
+		if seg.records == 0 && active {
+			return nil, io.EOF
+		}
+
+		var rec *spoolRecord
+		err := io.EOF
+		if s.r == nil && seg.records > 0 {
+			s.r, err = os.Open(s.segmentPath(seg.id))
+		}
+		if s.r != nil {
+			rec, err = readRecord(s.r, s.rOff)
+		}
+		if err == nil {
+			s.oldest = rec.time
+			return rec, nil
+		}
+		if active && err == io.EOF {
+			return nil, io.EOF
+		}
+
+		// the segment is done or can not be read any further
+		if err != io.EOF {
+			log.Printf("spool segment %d dropped at %d: %v", seg.id, s.rOff, err)
+		}
+		s.dropFirst()
+	}
+}
+
+// dropFirst removes the first segment and the records left in it
+func (s *Spool) dropFirst() {
+	seg := s.segments[0]
+	if s.r != nil {
+		s.r.Close()
+		s.r = nil
+	}
+	if len(s.segments) == 1 {
+		// the segment written to, continue in a new one
+		if s.w != nil {
+			s.w.Close()
+			s.w = nil
+		}
+		s.segments = append(s.segments, &spoolSegment{id: seg.id + 1})
+	}
+
+	s.depth -= seg.records
+	s.bytes -= seg.bytes
+	s.segments = s.segments[1:]
+	s.rOff = 0
+	s.writeCursor()
+	os.Remove(s.segmentPath(seg.id))
+}
+
+// advance marks rec replayed
+func (s *Spool) advance(rec *spoolRecord) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	seg := s.segments[0]
+	seg.records--
+	seg.bytes -= rec.size
+	s.depth--
+	s.bytes -= rec.size
+	s.rOff += rec.size
+	if s.depth == 0 {
+		s.oldest = time.Time{}
+	}
+	s.writeCursor()
+}
+
+func (s *Spool) replayLoop() {
+	defer close(s.done)
+
+	backoff := s.config.MinBackoff
+	for {
+		rec, err := s.next()
+		if err != nil {
+			select {
+			case <-s.notify:
+				continue
+			case <-s.exitChan:
+				return
+			}
+		}
+
+		for s.publish(rec.topic, rec.body) != nil {
+			select {
+			case <-time.After(backoff):
+			case <-s.exitChan:
+				return
+			}
+			if backoff *= 2; backoff > s.config.MaxBackoff {
+				backoff = s.config.MaxBackoff
+			}
+		}
+		backoff = s.config.MinBackoff
+
+		s.advance(rec)
+	}
+}
+
+// Close stops replaying, the messages left are replayed once reopened
+func (s *Spool) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.lock.Unlock()
+
+	close(s.exitChan)
+	<-s.done
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.r != nil {
+		s.r.Close()
+	}
+	if s.w != nil {
+		return s.w.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,228 @@
+package gotcp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPublisher records the messages published while it is up
+type testPublisher struct {
+	lock  sync.Mutex
+	up    bool
+	limit int // the publishes that succeed before it goes down, no limit if 0
+	got   []string
+}
+
+func (p *testPublisher) publish(topic string, body []byte) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !p.up {
+		return errors.New("broker down")
+	}
+	p.got = append(p.got, topic+":"+string(body))
+	if p.limit > 0 && len(p.got) >= p.limit {
+		p.up = false
+	}
+	return nil
+}
+
+func (p *testPublisher) setUp(up bool) {
+	p.lock.Lock()
+	p.up = up
+	p.lock.Unlock()
+}
+
+func (p *testPublisher) published() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]string(nil), p.got...)
+}
+
+func testSpoolConfig(dir string) *SpoolConfig {
+	return &SpoolConfig{
+		Dir:         dir,
+		SegmentSize: 64,
+		MinBackoff:  time.Millisecond,
+		MaxBackoff:  5 * time.Millisecond,
+	}
+}
+
+func waitDrained(t *testing.T, s *Spool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Stats().Depth > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("spool not drained: %+v", s.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSpoolRecord(t *testing.T) {
+	now := time.Unix(0, 1234567890)
+	record := appendRecord(nil, "topic", []byte("body"), now)
+	if len(record) != spoolHeaderSize+len("topic")+len("body") {
+		t.Fatalf("record of %d bytes", len(record))
+	}
+
+	name := filepath.Join(t.TempDir(), "segment")
+	os.WriteFile(name, append(record, record[:5]...), 0644)
+	f, _ := os.Open(name)
+	defer f.Close()
+
+	rec, err := readRecord(f, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.topic != "topic" || string(rec.body) != "body" || !rec.time.Equal(now) || rec.size != int64(len(record)) {
+		t.Fatalf("read back %+v", rec)
+	}
+	if _, err := readRecord(f, rec.size); err != io.EOF {
+		t.Fatalf("torn tail: %v", err)
+	}
+
+	corrupt := append([]byte(nil), record...)
+	corrupt[len(corrupt)-1] ^= 0xFF
+	os.WriteFile(name, corrupt, 0644)
+	f2, _ := os.Open(name)
+	defer f2.Close()
+	if _, err := readRecord(f2, 0); err != errSpoolCorrupt {
+		t.Fatalf("bad checksum: %v", err)
+	}
+}
+
+func TestSpoolReplayInOrder(t *testing.T) {
+	dir := t.TempDir()
+	p := &testPublisher{}
+	s, err := OpenSpool(testSpoolConfig(dir), p.publish)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := s.Publish("t", []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st := s.Stats(); st.Depth != 10 || st.Segments < 2 {
+		t.Fatalf("stats %+v", st)
+	}
+	s.Close()
+
+	s, err = OpenSpool(testSpoolConfig(dir), p.publish)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if st := s.Stats(); st.Depth != 10 || st.Age <= 0 {
+		t.Fatalf("reopened stats %+v", st)
+	}
+
+	// published behind the spooled ones even though the broker is back
+	p.setUp(true)
+	s.Publish("t", []byte("10"))
+	waitDrained(t, s)
+
+	got := p.published()
+	if len(got) != 11 {
+		t.Fatalf("published %v", got)
+	}
+	for i, g := range got {
+		if g != fmt.Sprintf("t:%d", i) {
+			t.Fatalf("published %v", got)
+		}
+	}
+}
+
+func TestSpoolCursorRecovery(t *testing.T) {
+	dir := t.TempDir()
+	p := &testPublisher{}
+	s, err := OpenSpool(testSpoolConfig(dir), p.publish)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		s.Append("t", []byte(fmt.Sprint(i)))
+	}
+
+	// the broker takes two and goes down again
+	p.lock.Lock()
+	p.up, p.limit = true, 2
+	p.lock.Unlock()
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Stats().Depth > 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	s.Close()
+
+	s, err = OpenSpool(testSpoolConfig(dir), p.publish)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if st := s.Stats(); st.Depth != 3 {
+		t.Fatalf("reopened stats %+v", st)
+	}
+
+	p.lock.Lock()
+	p.up, p.limit = true, 0
+	p.lock.Unlock()
+	s.Publish("t", []byte("5"))
+	waitDrained(t, s)
+
+	want := []string{"t:0", "t:1", "t:2", "t:3", "t:4", "t:5"}
+	if got := p.published(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("published %v, want %v", got, want)
+	}
+}
+
+func TestSpoolTornTail(t *testing.T) {
+	dir := t.TempDir()
+	p := &testPublisher{}
+	config := testSpoolConfig(dir)
+	config.SegmentSize = 1 << 20
+	s, err := OpenSpool(config, p.publish)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		s.Append("t", []byte(fmt.Sprint(i)))
+	}
+	s.Close()
+
+	// a crash while appending leaves half a record
+	names, _ := filepath.Glob(filepath.Join(dir, "*"+spoolFileExt))
+	if len(names) != 1 {
+		t.Fatalf("segments %v", names)
+	}
+	torn := appendRecord(nil, "t", []byte("torn"), time.Now())
+	f, _ := os.OpenFile(names[0], os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write(torn[:len(torn)-2])
+	f.Close()
+
+	s, err = OpenSpool(config, p.publish)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if st := s.Stats(); st.Depth != 3 {
+		t.Fatalf("reopened stats %+v", st)
+	}
+
+	// appended to a new segment, not after the torn record
+	s.Append("t", []byte("3"))
+	p.setUp(true)
+	s.Publish("t", nil)
+	waitDrained(t, s)
+
+	got := p.published()
+	if len(got) != 5 || got[3] != "t:3" || bytes.Contains([]byte(fmt.Sprint(got)), []byte("torn")) {
+		t.Fatalf("published %v", got)
+	}
+}
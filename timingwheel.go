@@ -0,0 +1,117 @@
+package gotcp
+
+import (
+	"sync"
+	"time"
+)
+
+// timingWheel is a hashed timing wheel, one goroutine drives the timers of
+// every connection instead of one ticker per connection
+type timingWheel struct {
+	interval time.Duration
+	lock     sync.Mutex
+	slots    []map[*wheelTimer]struct{}
+	pos      int
+
+	exitChan  chan struct{}
+	startOnce sync.Once
+	stopOnce  sync.Once
+}
+
+// wheelTimer is a timer added to a timingWheel
+type wheelTimer struct {
+	w      *timingWheel
+	slot   int
+	rounds int // the turns of the wheel left before it fires
+	f      func()
+}
+
+// newTimingWheel creates a wheel of n slots advancing every interval
+func newTimingWheel(interval time.Duration, n int) *timingWheel {
+	w := &timingWheel{
+		interval: interval,
+		slots:    make([]map[*wheelTimer]struct{}, n),
+		exitChan: make(chan struct{}),
+	}
+	for i := range w.slots {
+		w.slots[i] = make(map[*wheelTimer]struct{})
+	}
+
+	return w
+}
+
+// start starts the goroutine driving the wheel
+func (w *timingWheel) start() {
+	w.startOnce.Do(func() {
+		go w.run()
+	})
+}
+
+// stop stops the wheel, pending timers never fire
+func (w *timingWheel) stop() {
+	w.stopOnce.Do(func() {
+		close(w.exitChan)
+	})
+}
+
+// AfterFunc calls f in its own goroutine once d has elapsed,
+// rounded up to the wheel interval
+func (w *timingWheel) AfterFunc(d time.Duration, f func()) *wheelTimer {
+	ticks := int((d + w.interval - 1) / w.interval)
+	if ticks < 1 {
+		ticks = 1
+	}
+
+	t := &wheelTimer{w: w, f: f}
+
+	w.lock.Lock()
+	t.slot = (w.pos + ticks) % len(w.slots)
+	t.rounds = (ticks - 1) / len(w.slots)
+	w.slots[t.slot][t] = struct{}{}
+	w.lock.Unlock()
+
+	return t
+}
+
+// Stop prevents the timer from firing
+func (t *wheelTimer) Stop() {
+	t.w.lock.Lock()
+	delete(t.w.slots[t.slot], t)
+	t.w.lock.Unlock()
+}
+
+func (w *timingWheel) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.exitChan:
+			return
+
+		case <-ticker.C:
+			w.advance()
+		}
+	}
+}
+
+func (w *timingWheel) advance() {
+	var expired []*wheelTimer
+
+	w.lock.Lock()
+	w.pos = (w.pos + 1) % len(w.slots)
+	slot := w.slots[w.pos]
+	for t := range slot {
+		if t.rounds > 0 {
+			t.rounds--
+			continue
+		}
+		delete(slot, t)
+		expired = append(expired, t)
+	}
+	w.lock.Unlock()
+
+	for _, t := range expired {
+		go t.f()
+	}
+}
@@ -0,0 +1,76 @@
+package gotcp
+
+import (
+	"testing"
+	"time"
+)
+
+// pending tells whether t is still waiting in its slot
+func (t *wheelTimer) pending() bool {
+	t.w.lock.Lock()
+	defer t.w.lock.Unlock()
+
+	_, ok := t.w.slots[t.slot][t]
+	return ok
+}
+
+func TestTimingWheelRounds(t *testing.T) {
+	const slots = 4
+	interval := time.Second
+
+	for _, v := range []struct {
+		d     time.Duration
+		ticks int
+	}{
+		{0, 1},
+		{interval / 2, 1},
+		{interval, 1},
+		{interval * 5 / 2, 3},
+		{slots * interval, slots},
+		{(slots + 1) * interval, slots + 1},
+		{2 * slots * interval, 2 * slots},
+		{(3*slots - 1) * interval, 3*slots - 1},
+	} {
+		// the wheel is driven by hand, from every position
+		for start := 0; start < slots; start++ {
+			w := newTimingWheel(interval, slots)
+			w.pos = start
+
+			fired := make(chan struct{})
+			timer := w.AfterFunc(v.d, func() { close(fired) })
+			for tick := 1; tick < v.ticks; tick++ {
+				w.advance()
+				if !timer.pending() {
+					t.Fatalf("%v from slot %d fired after %d ticks, expected %d", v.d, start, tick, v.ticks)
+				}
+			}
+
+			w.advance()
+			if timer.pending() {
+				t.Fatalf("%v from slot %d did not fire after %d ticks", v.d, start, v.ticks)
+			}
+			select {
+			case <-fired:
+			case <-time.After(time.Second):
+				t.Fatalf("%v from slot %d: f not called", v.d, start)
+			}
+		}
+	}
+}
+
+func TestTimingWheelStop(t *testing.T) {
+	w := newTimingWheel(time.Millisecond, 4)
+	w.start()
+	defer w.stop()
+
+	stopped := w.AfterFunc(time.Millisecond, func() { t.Error("stopped timer fired") })
+	stopped.Stop()
+
+	fired := make(chan struct{})
+	w.AfterFunc(10*time.Millisecond, func() { close(fired) })
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatal("timer did not fire")
+	}
+}
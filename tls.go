@@ -0,0 +1,57 @@
+package gotcp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"time"
+)
+
+// defaultHandshakeTimeout bounds the TLS handshake when Config.HandshakeTimeout is 0
+const defaultHandshakeTimeout = 10 * time.Second
+
+// NewTLSConfig creates a server side tls.Config from PEM files. If
+// clientCAFile is not empty, clients must present a certificate signed
+// by one of its CAs (mutual TLS).
+func NewTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// CertIdentity is the default Config.PeerIdentity, it returns the subject
+// common name of cert, or its first DNS SAN if the common name is empty
+func CertIdentity(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+
+	return ""
+}
@@ -0,0 +1,246 @@
+package gotcp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a certificate for the common name cn and the DNS SANs dns
+func (ca *testCA) issue(t *testing.T, cn string, dns []string, usage x509.ExtKeyUsage) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dns,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// tlsCallback reports the conns accepted and why they were closed
+type tlsCallback struct {
+	lineCallback
+	connected chan *Conn
+	closed    chan CloseReason
+}
+
+func (cb tlsCallback) OnConnect(c *Conn) bool {
+	cb.connected <- c
+	return true
+}
+
+func (cb tlsCallback) OnCloseReason(c *Conn, reason CloseReason) {
+	cb.closed <- reason
+}
+
+// startTLSServer serves mutual TLS with a server certificate of ca
+func startTLSServer(t *testing.T, ca *testCA, config *Config) (*pipeListener, tlsCallback) {
+	config.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "gateway", []string{"gateway"}, x509.ExtKeyUsageServerAuth)},
+		ClientCAs:    ca.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+	cb := tlsCallback{connected: make(chan *Conn, 4), closed: make(chan CloseReason, 4)}
+	_, l := startPipeServer(t, config, cb, nil)
+
+	return l, cb
+}
+
+// dialTLS runs the client handshake, with cert if it is not nil
+func dialTLS(t *testing.T, l *pipeListener, ca *testCA, cert *tls.Certificate) (*tls.Conn, error) {
+	config := &tls.Config{RootCAs: ca.pool, ServerName: "gateway"}
+	if cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+
+	conn := tls.Client(l.Dial(), config)
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+
+	// TLS 1.3 reports a rejected client certificate on the first read
+	conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			return nil, err
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	return conn, nil
+}
+
+func TestTLSPeerIdentity(t *testing.T) {
+	ca := newTestCA(t)
+	l, cb := startTLSServer(t, ca, &Config{})
+
+	cert := ca.issue(t, "AABBCCDDEEFF", nil, x509.ExtKeyUsageClientAuth)
+	if _, err := dialTLS(t, l, ca, &cert); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case c := <-cb.connected:
+		if c.PeerIdentity() != "AABBCCDDEEFF" || c.PeerCertificate() == nil || c.PeerCertificate().Subject.CommonName != "AABBCCDDEEFF" {
+			t.Fatalf("identity %q", c.PeerIdentity())
+		}
+		if c.GetRawConn() != nil {
+			t.Fatal("raw TCP conn of a pipe")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("conn not accepted")
+	}
+}
+
+func TestTLSIdentityFromSAN(t *testing.T) {
+	ca := newTestCA(t)
+	l, cb := startTLSServer(t, ca, &Config{})
+
+	cert := ca.issue(t, "", []string{"bed-1.example", "bed-2.example"}, x509.ExtKeyUsageClientAuth)
+	if _, err := dialTLS(t, l, ca, &cert); err != nil {
+		t.Fatal(err)
+	}
+	if c := <-cb.connected; c.PeerIdentity() != "bed-1.example" {
+		t.Fatalf("identity %q", c.PeerIdentity())
+	}
+
+	l, cb = startTLSServer(t, ca, &Config{PeerIdentity: func(cert *x509.Certificate) string {
+		return "custom " + cert.DNSNames[1]
+	}})
+	if _, err := dialTLS(t, l, ca, &cert); err != nil {
+		t.Fatal(err)
+	}
+	if c := <-cb.connected; c.PeerIdentity() != "custom bed-2.example" {
+		t.Fatalf("identity %q", c.PeerIdentity())
+	}
+}
+
+func TestTLSRejectsUnverifiedClients(t *testing.T) {
+	ca := newTestCA(t)
+	l, cb := startTLSServer(t, ca, &Config{})
+
+	other := newTestCA(t)
+	forged := other.issue(t, "AABBCCDDEEFF", nil, x509.ExtKeyUsageClientAuth)
+	for name, cert := range map[string]*tls.Certificate{"no certificate": nil, "unknown CA": &forged} {
+		if _, err := dialTLS(t, l, ca, cert); err == nil {
+			t.Fatalf("%s: handshake succeeded", name)
+		}
+
+		select {
+		case reason := <-cb.closed:
+			if reason.Kind != CloseHandshake {
+				t.Fatalf("%s: closed with %v", name, reason)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: conn not closed", name)
+		}
+	}
+
+	select {
+	case c := <-cb.connected:
+		t.Fatalf("unverified conn %q accepted", c.PeerIdentity())
+	default:
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	ca := newTestCA(t)
+	l, cb := startTLSServer(t, ca, &Config{HandshakeTimeout: 20 * time.Millisecond})
+
+	// a client that never starts the handshake
+	conn := l.Dial()
+	defer conn.Close()
+
+	select {
+	case reason := <-cb.closed:
+		if reason.Kind != CloseHandshake {
+			t.Fatalf("closed with %v", reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("silent client not closed")
+	}
+}
+
+func TestTLSRawConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	ca := newTestCA(t)
+	cb := tlsCallback{connected: make(chan *Conn, 1), closed: make(chan CloseReason, 1)}
+	config := &Config{PacketSendChanLimit: 1, PacketReceiveChanLimit: 1, TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "gateway", []string{"gateway"}, x509.ExtKeyUsageServerAuth)},
+	}}
+	srv := NewServer(config, cb, lineProtocol{}, nil)
+	go srv.Start(ln, 10*time.Millisecond)
+	defer srv.Stop()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: ca.pool, ServerName: "gateway"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case c := <-cb.connected:
+		if raw := c.GetRawConn(); raw == nil || raw.RemoteAddr().String() != conn.LocalAddr().String() {
+			t.Fatalf("raw conn %v", raw)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("conn not accepted")
+	}
+}
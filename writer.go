@@ -0,0 +1,296 @@
+package gotcp
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultWriteBatchSize = 64
+	maxEncodeBufSize      = 64 * 1024 // the encode buffer is dropped when it grows larger
+)
+
+// Priority selects the send queue of a packet, the writer always
+// drains the queues of higher priority first
+type Priority int
+
+const (
+	PriorityControl Priority = iota // acks and heartbeats answering the peer
+	PriorityBroker                  // commands coming from the message broker
+	PriorityBulk                    // everything that can wait
+
+	priorityLanes = 3
+)
+
+// WritePacket passes a packet through the outbound pipeline and queues it
+// for the writer with the given priority, this method will never block
+// longer than timeout, 0 means not at all and a negative timeout until
+// the packet is queued or the conn closes
+func (c *Conn) WritePacket(p Packet, priority Priority, timeout time.Duration) error {
+	if c.IsClosed() {
+		return ErrConnClosing
+	}
+
+	if priority < 0 || priority >= priorityLanes {
+		priority = PriorityBulk
+	}
+
+	return c.srv.pipeline.write(c, 0, p, priority, timeout)
+}
+
+// enqueue queues a packet for the writer
+func (c *Conn) enqueue(p Packet, priority Priority, timeout time.Duration) error {
+	if c.IsClosed() {
+		return ErrConnClosing
+	}
+
+	ch := c.packetSendChans[priority]
+
+	if timeout == 0 {
+		select {
+		case ch <- p:
+			return nil
+
+		default:
+			return ErrWriteBlocking
+		}
+
+	} else {
+		// a negative timeout never expires
+		var expired <-chan time.Time
+		if timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			expired = timer.C
+		}
+
+		select {
+		case ch <- p:
+			return nil
+
+		case <-c.closeChan:
+			return ErrConnClosing
+
+		case <-expired:
+			return ErrWriteBlocking
+		}
+	}
+}
+
+// WriteStats counts the writes of a conn or a server,
+// Packets/Batches tells how well the writes are coalesced
+type WriteStats struct {
+	Batches uint64 // writes issued to the raw connection
+	Packets uint64 // packets written
+	Bytes   uint64 // bytes written
+
+	EncodeErrors uint64 // packets dropped because they could not be encoded
+}
+
+// writeCounters is the atomically updated form of WriteStats
+type writeCounters struct {
+	batches      uint64
+	packets      uint64
+	bytes        uint64
+	encodeErrors uint64
+}
+
+func (w *writeCounters) add(packets int, bytes int64) {
+	atomic.AddUint64(&w.batches, 1)
+	atomic.AddUint64(&w.packets, uint64(packets))
+	atomic.AddUint64(&w.bytes, uint64(bytes))
+}
+
+func (w *writeCounters) load() WriteStats {
+	return WriteStats{
+		Batches: atomic.LoadUint64(&w.batches),
+		Packets: atomic.LoadUint64(&w.packets),
+		Bytes:   atomic.LoadUint64(&w.bytes),
+
+		EncodeErrors: atomic.LoadUint64(&w.encodeErrors),
+	}
+}
+
+// WriteStats returns the write counters of the conn
+func (c *Conn) WriteStats() WriteStats {
+	return c.writeStats.load()
+}
+
+// writeLoop is the only goroutine writing to the raw connection, it
+// coalesces the queued packets into one vectored write
+func (c *Conn) writeLoop() {
+	defer func() {
+		if r := recover(); r != nil {
+			c.close(panicReason(r))
+		}
+		c.writeWait.Done()
+		c.srv.waitGroup.Done()
+	}()
+
+	var batch net.Buffers
+	for {
+		p, ok := c.nextPacket(nil)
+		if !ok {
+			if !c.IsClosed() {
+				c.flush(batch)
+			}
+			return
+		}
+
+		batch = c.fillBatch(c.appendPacket(batch[:0], p), c.srv.config.WriteFlushLatency)
+		if err := c.writeBatch(batch); err != nil {
+			c.close(CloseReason{Kind: CloseWriteError, Err: err})
+			return
+		}
+	}
+}
+
+// fillBatch appends the queued packets to batch up to Config.WriteBatchSize,
+// waiting at most latency for more packets to come
+func (c *Conn) fillBatch(batch net.Buffers, latency time.Duration) net.Buffers {
+	limit := c.srv.config.WriteBatchSize
+	if limit <= 0 {
+		limit = defaultWriteBatchSize
+	}
+
+	var deadline <-chan time.Time
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for len(batch) < limit {
+		p, ok := c.queuedPacket()
+		if !ok {
+			if deadline == nil {
+				break
+			}
+			if p, ok = c.nextPacket(deadline); !ok {
+				break
+			}
+		}
+		batch = c.appendPacket(batch, p)
+	}
+
+	return batch
+}
+
+// appendPacket encodes p and appends it to batch, Encoder packets are
+// encoded into the encode buffer of the conn
+func (c *Conn) appendPacket(batch net.Buffers, p Packet) net.Buffers {
+	var b []byte
+	if enc, ok := p.(Encoder); ok {
+		start := len(c.encodeBuf)
+		buf, err := enc.AppendTo(c.encodeBuf)
+		if err != nil {
+			c.encodeError(p, err)
+			return batch
+		}
+		c.encodeBuf = buf
+		b = buf[start:]
+	} else {
+		b = p.Serialize()
+	}
+
+	if len(b) == 0 {
+		return batch
+	}
+
+	return append(batch, b)
+}
+
+func (c *Conn) encodeError(p Packet, err error) {
+	atomic.AddUint64(&c.writeStats.encodeErrors, 1)
+	atomic.AddUint64(&c.srv.writeStats.encodeErrors, 1)
+
+	if cb, ok := c.srv.callback.(ErrorCallback); ok {
+		cb.OnError(c, &EncodeError{Packet: p, Err: err})
+	}
+}
+
+// writeBatch writes batch with one writev where the raw connection supports it
+func (c *Conn) writeBatch(batch net.Buffers) error {
+	packets := len(batch)
+	if packets == 0 {
+		return nil
+	}
+
+	bufs := batch
+	n, err := bufs.WriteTo(c.conn)
+	for i := range batch {
+		batch[i] = nil
+	}
+	if cap(c.encodeBuf) > maxEncodeBufSize {
+		c.encodeBuf = nil
+	}
+	c.encodeBuf = c.encodeBuf[:0]
+
+	c.writeStats.add(packets, n)
+	c.srv.writeStats.add(packets, n)
+	if err != nil {
+		return err
+	}
+	c.touchWrite()
+
+	return nil
+}
+
+// nextPacket blocks until a packet is queued or timeout fires and returns
+// the queued packet of the highest priority. It returns false on timeout,
+// when the conn is closed or when the server shuts down.
+func (c *Conn) nextPacket(timeout <-chan time.Time) (Packet, bool) {
+	if p, ok := c.queuedPacket(); ok {
+		return p, true
+	}
+
+	select {
+	case <-timeout:
+		return nil, false
+
+	case <-c.srv.exitChan:
+		return nil, false
+
+	case <-c.closeChan:
+		return nil, false
+
+	case p, ok := <-c.packetSendChans[PriorityControl]:
+		return p, ok
+
+	case p, ok := <-c.packetSendChans[PriorityBroker]:
+		return p, ok
+
+	case p, ok := <-c.packetSendChans[PriorityBulk]:
+		return p, ok
+	}
+}
+
+// queuedPacket returns the queued packet of the highest priority without blocking
+func (c *Conn) queuedPacket() (Packet, bool) {
+	for _, ch := range c.packetSendChans {
+		select {
+		case p, ok := <-ch:
+			return p, ok
+
+		default:
+		}
+	}
+
+	return nil, false
+}
+
+// flush writes out the packets still queued without waiting for more
+func (c *Conn) flush(batch net.Buffers) {
+	for {
+		p, ok := c.queuedPacket()
+		if !ok {
+			return
+		}
+
+		batch = c.fillBatch(c.appendPacket(batch[:0], p), 0)
+		if err := c.writeBatch(batch); err != nil {
+			return
+		}
+	}
+}
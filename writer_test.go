@@ -0,0 +1,125 @@
+package gotcp
+
+import (
+	"testing"
+	"time"
+)
+
+// blockWriter queues first and waits until the writer took it, the
+// writer then blocks on it until the device reads
+func blockWriter(t *testing.T, c *Conn, first Packet) {
+	if err := c.WritePacket(first, PriorityBulk, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(c.packetSendChans[PriorityBulk]) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("writer did not take the packet")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(5 * time.Millisecond) // lets the writer reach the write
+}
+
+func expectLines(t *testing.T, lines <-chan string, expected ...string) {
+	t.Helper()
+	for _, line := range expected {
+		if got := receive(t, lines, line); got != line {
+			t.Fatalf("device read %q, expected %q", got, line)
+		}
+	}
+}
+
+func TestWriterPriority(t *testing.T) {
+	srv, l, _ := startRequestServer(t, &Config{WriteBatchSize: 1})
+	_, c, read, lines := requestDevice(t, srv, l, "BED")
+
+	blockWriter(t, c, &linePacket{kind: "BULK", arg: "0"})
+	c.WritePacket(&linePacket{kind: "BULK", arg: "1"}, PriorityBulk, time.Second)
+	c.WritePacket(&linePacket{kind: "BULK", arg: "2"}, PriorityBulk, time.Second)
+	c.NsqWritePacket(&linePacket{kind: "BROKER", arg: "3"}, time.Second)
+	c.AsyncWritePacket(&linePacket{kind: "CONTROL", arg: "4"}, time.Second)
+
+	read <- true
+	expectLines(t, lines, "BULK 0", "CONTROL 4", "BROKER 3", "BULK 1", "BULK 2")
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	srv, l, _ := startRequestServer(t, &Config{})
+	conn, c, _, _ := requestDevice(t, srv, l, "BED")
+	conn.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !c.IsClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("conn not closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the lanes stay open, late senders fail instead of panicking
+	for priority := Priority(0); priority < priorityLanes; priority++ {
+		if err := c.enqueue(&linePacket{kind: "PING", arg: "0"}, priority, time.Second); err != ErrConnClosing {
+			t.Fatalf("lane %d: %v", priority, err)
+		}
+	}
+}
+
+// waitPackets waits until the writer of c wrote packets
+func waitPackets(t *testing.T, c *Conn, packets uint64) WriteStats {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		stats := c.WriteStats()
+		if stats.Packets >= packets {
+			return stats
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d packets written, expected %d", stats.Packets, packets)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWriteBatchSize(t *testing.T) {
+	srv, l, _ := startRequestServer(t, &Config{WriteBatchSize: 2})
+	_, c, read, lines := requestDevice(t, srv, l, "BED")
+
+	blockWriter(t, c, &linePacket{kind: "BULK", arg: "0"})
+	for _, arg := range []string{"1", "2", "3", "4", "5"} {
+		c.WritePacket(&linePacket{kind: "BULK", arg: arg}, PriorityBulk, time.Second)
+	}
+
+	read <- true
+	expectLines(t, lines, "BULK 0", "BULK 1", "BULK 2", "BULK 3", "BULK 4", "BULK 5")
+
+	// [0] [1 2] [3 4] [5]
+	stats := waitPackets(t, c, 6)
+	if stats.Batches != 4 || stats.Packets != 6 || stats.Bytes != uint64(6*len("BULK 0\n")) {
+		t.Fatalf("stats %+v", stats)
+	}
+	if server := srv.WriteStats(); server.Batches < stats.Batches || server.Packets < stats.Packets {
+		t.Fatalf("server stats %+v, conn stats %+v", server, stats)
+	}
+}
+
+func TestWriteFlushLatency(t *testing.T) {
+	latency := 50 * time.Millisecond
+	srv, l, _ := startRequestServer(t, &Config{WriteFlushLatency: latency})
+	_, c, read, lines := requestDevice(t, srv, l, "BED")
+	read <- true
+
+	start := time.Now()
+	c.AsyncWritePacket(&linePacket{kind: "PING", arg: "1"}, time.Second)
+	time.Sleep(latency / 5)
+	c.AsyncWritePacket(&linePacket{kind: "PING", arg: "2"}, time.Second)
+
+	// the first packet waits for the second one, both go out in one write
+	expectLines(t, lines, "PING 1", "PING 2")
+	if elapsed := time.Since(start); elapsed < latency*4/5 {
+		t.Fatalf("written after %v, the flush latency is %v", elapsed, latency)
+	}
+	if stats := waitPackets(t, c, 2); stats.Batches != 1 || stats.Packets != 2 {
+		t.Fatalf("stats %+v", stats)
+	}
+}